@@ -0,0 +1,85 @@
+package sampquery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen is returned by Breaker when a host has failed too many times in a row and is
+// being skipped until its cooldown ends.
+var ErrCircuitOpen = errors.New("circuit open after repeated failures")
+
+// Breaker wraps GetServerInfo with a per-host circuit breaker. Once a host fails threshold times in
+// a row, queries to it fail immediately with ErrCircuitOpen for the cooldown instead of each one
+// waiting out the full timeout. After the cooldown a single query is let through: success closes
+// the circuit again, failure reopens it for another cooldown. A Breaker is safe for concurrent use.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	opts      []Option
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// NewBreaker creates a circuit breaker which opens after threshold consecutive failures for a host
+// and stays open for cooldown, opts are passed to every query.
+func NewBreaker(threshold int, cooldown time.Duration, opts ...Option) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		opts:      opts,
+		hosts:     make(map[string]*breakerState),
+	}
+}
+
+// GetServerInfo queries host with GetServerInfo unless its circuit is open.
+func (b *Breaker) GetServerInfo(ctx context.Context, host string, attemptDecode bool) (Server, error) {
+	b.mu.Lock()
+	// only hosts that are currently failing have any state, so the map doesn't grow with every host
+	// ever queried
+	now := time.Now()
+	if state, ok := b.hosts[host]; ok {
+		if now.Before(state.openUntil) {
+			b.mu.Unlock()
+			return Server{Address: host}, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+		}
+		if state.failures >= b.threshold {
+			// half-open: hold the circuit shut against everyone else while this query probes the host
+			state.openUntil = now.Add(b.cooldown)
+		}
+	}
+	b.mu.Unlock()
+
+	server, err := GetServerInfo(ctx, host, attemptDecode, b.opts...)
+
+	b.mu.Lock()
+	if err != nil {
+		state, ok := b.hosts[host]
+		if !ok {
+			state = &breakerState{}
+			b.hosts[host] = state
+		}
+		state.failures++
+		if state.failures >= b.threshold {
+			state.openUntil = time.Now().Add(b.cooldown)
+		}
+	} else {
+		delete(b.hosts, host)
+	}
+	b.mu.Unlock()
+
+	return server, err
+}
@@ -0,0 +1,81 @@
+package sampquery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker_GetServerInfo(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+	host := silent.LocalAddr().String()
+
+	breaker := NewBreaker(2, 300*time.Millisecond)
+
+	query := func() (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := breaker.GetServerInfo(ctx, host, false)
+		return time.Since(start), err
+	}
+
+	// the first two failures wait out the timeout and open the circuit
+	for i := 0; i < 2; i++ {
+		_, err := query()
+		assert.EqualError(t, err, host+": socket read timed out")
+	}
+
+	elapsed, err := query()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.True(t, elapsed < 10*time.Millisecond, "took %s", elapsed)
+
+	// once the cooldown is over the host is tried again, and reopens on failure
+	time.Sleep(300 * time.Millisecond)
+	_, err = query()
+	assert.EqualError(t, err, host+": socket read timed out")
+
+	_, err = query()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+}
+
+func TestBreaker_Recovers(t *testing.T) {
+	var online int32
+	addr := mockServer(t, func(request []byte) []byte {
+		if atomic.LoadInt32(&online) == 0 {
+			return nil
+		}
+		return sampReply(request)
+	})
+
+	breaker := NewBreaker(1, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err := breaker.GetServerInfo(ctx, addr, false)
+	cancel()
+	assert.Error(t, err)
+
+	atomic.StoreInt32(&online, 1)
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server, err := breaker.GetServerInfo(ctx, addr, false)
+		cancel()
+		assert.NoError(t, err)
+		assert.Equal(t, "hostname", server.Hostname)
+	}
+
+	// a recovered host is forgotten rather than kept around forever
+	breaker.mu.Lock()
+	assert.Empty(t, breaker.hosts)
+	breaker.mu.Unlock()
+}
@@ -0,0 +1,117 @@
+package sampquery
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache wraps GetServerInfo with an in-memory cache keyed by host. Results are reused until they're
+// older than the cache's TTL, which saves server browsers re-querying servers on every refresh.
+// Failed queries aren't cached and expired results are swept out as new ones are added, so a cache
+// used across a scan doesn't hold on to every server it's seen. A Cache is safe for concurrent use.
+type Cache struct {
+	ttl  time.Duration
+	opts []Option
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	swept   time.Time
+}
+
+type cacheKey struct {
+	host          string
+	attemptDecode bool
+}
+
+type cacheEntry struct {
+	server  Server
+	expires time.Time
+}
+
+// NewCache creates a cache which holds on to results for ttl, opts are passed to every query.
+func NewCache(ttl time.Duration, opts ...Option) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		opts:    opts,
+		entries: make(map[cacheKey]cacheEntry),
+	}
+}
+
+// GetServerInfo returns the cached result for host if it's still fresh, otherwise it queries the
+// server with GetServerInfo and caches the result.
+func (c *Cache) GetServerInfo(ctx context.Context, host string, attemptDecode bool) (Server, error) {
+	key := cacheKey{host, attemptDecode}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return copyServer(entry.server), nil
+	}
+
+	server, err := GetServerInfo(ctx, host, attemptDecode, c.opts...)
+	if err != nil {
+		return server, err
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	// sweeping at most once per TTL keeps inserts cheap while bounding the cache to roughly what was
+	// added in the last two TTLs
+	if now.Sub(c.swept) >= c.ttl {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[key] = cacheEntry{server: copyServer(server), expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+
+	return server, nil
+}
+
+// copyServer copies the maps in a server so cached results can't be modified by callers.
+func copyServer(server Server) Server {
+	if server.Rules != nil {
+		rules := make(map[string]string, len(server.Rules))
+		for k, v := range server.Rules {
+			rules[k] = v
+		}
+		server.Rules = rules
+	}
+	if server.Answered != nil {
+		answered := make(map[QueryType]bool, len(server.Answered))
+		for k, v := range server.Answered {
+			answered[k] = v
+		}
+		server.Answered = answered
+	}
+	server.RawHostname = cloneBytes(server.RawHostname)
+	server.RawGamemode = cloneBytes(server.RawGamemode)
+	server.RawLanguage = cloneBytes(server.RawLanguage)
+	if server.DetectedEncoding != nil {
+		encodings := make(map[string]string, len(server.DetectedEncoding))
+		for k, v := range server.DetectedEncoding {
+			encodings[k] = v
+		}
+		server.DetectedEncoding = encodings
+	}
+	if server.DetectionConfidence != nil {
+		confidence := make(map[string]int, len(server.DetectionConfidence))
+		for k, v := range server.DetectionConfidence {
+			confidence[k] = v
+		}
+		server.DetectionConfidence = confidence
+	}
+	return server
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,76 @@
+package sampquery
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_GetServerInfo(t *testing.T) {
+	var infoQueries int32
+	addr := mockServer(t, func(request []byte) []byte {
+		if QueryType(request[10]) == Info {
+			atomic.AddInt32(&infoQueries, 1)
+		}
+		return sampReply(request)
+	})
+
+	cache := NewCache(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first, err := cache.GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&infoQueries))
+
+	// callers modifying their copy must not affect the cache
+	first.Rules["version"] = "modified"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server, err := cache.GetServerInfo(ctx, addr, false)
+			assert.NoError(t, err)
+			assert.Equal(t, "omp 1.2.0", server.Rules["version"])
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&infoQueries), "cached result should have been used")
+
+	time.Sleep(250 * time.Millisecond)
+
+	_, err = cache.GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&infoQueries), "expired result should have been refreshed")
+}
+
+func TestCache_Sweep(t *testing.T) {
+	first := mockSAMPServer(t, nil)
+	second := mockSAMPServer(t, nil)
+
+	cache := NewCache(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := cache.GetServerInfo(ctx, first, false)
+	assert.NoError(t, err)
+
+	// first is never asked for again, adding second once it's expired clears it out
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.GetServerInfo(ctx, second, false)
+	assert.NoError(t, err)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	assert.Len(t, cache.entries, 1)
+	_, ok := cache.entries[cacheKey{second, false}]
+	assert.True(t, ok)
+}
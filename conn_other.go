@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package sampquery
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused reports whether err is the OS telling us an earlier send hit a closed port.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
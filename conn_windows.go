@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package sampquery
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused reports whether err is Windows telling us an earlier send hit a closed port. It
+// reports this as WSAECONNRESET on the next read rather than as a refusal.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.WSAECONNRESET)
+}
@@ -0,0 +1,96 @@
+package sampquery
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseFavourites reads a list of server addresses, such as one exported from the SA:MP client's
+// favourites, ready to be passed to GetServerInfo or NewQuery. Addresses may be separated by new
+// lines or commas. Blank lines and anything after a '#' or "//" are ignored, and addresses without
+// a port are given the default of 7777. Duplicates are only returned once.
+func ParseFavourites(r io.Reader) (addresses []string, err error) {
+	entries, err := readFavourites(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		addresses = append(addresses, entry.address)
+	}
+	return addresses, nil
+}
+
+// favourite is an entry from a favourites list, either parsed into an address or with the error
+// that stopped it being parsed.
+type favourite struct {
+	entry   string
+	address string
+	err     error
+}
+
+// readFavourites does the work of ParseFavourites but carries on past invalid entries, returning
+// them in order alongside the valid ones.
+func readFavourites(r io.Reader) (entries []favourite, err error) {
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+
+		for _, entry := range strings.Split(text, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			address, err := parseFavourite(entry)
+			if err != nil {
+				entries = append(entries, favourite{entry: entry, err: errors.Wrapf(err, "line %d", line)})
+				continue
+			}
+			if !seen[address] {
+				seen[address] = true
+				entries = append(entries, favourite{entry: entry, address: address})
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read favourites")
+	}
+	return entries, nil
+}
+
+func parseFavourite(entry string) (string, error) {
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		// SplitHostPort only accepts a bare host if it's bracketed, so try again with the default
+		host, port, err = net.SplitHostPort(net.JoinHostPort(entry, "7777"))
+		if err != nil || strings.Contains(host, ":") {
+			return "", errors.Errorf("invalid address %q", entry)
+		}
+	}
+	if host == "" {
+		return "", errors.Errorf("address %q is missing a host", entry)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return "", errors.Errorf("address %q has invalid port %s", entry, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,33 @@
+package sampquery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFavourites(t *testing.T) {
+	addresses, err := ParseFavourites(strings.NewReader(`# exported favourites
+play.example.com:7777
+192.168.1.20:7778 // lan server
+
+server.example.com,  10.0.0.1:7780
+play.example.com:7777
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"play.example.com:7777",
+		"192.168.1.20:7778",
+		"server.example.com:7777",
+		"10.0.0.1:7780",
+	}, addresses)
+}
+
+func TestParseFavourites_Invalid(t *testing.T) {
+	_, err := ParseFavourites(strings.NewReader("play.example.com:7777\nplay.example.com:99999\n"))
+	assert.EqualError(t, err, `line 2: address "play.example.com:99999" has invalid port 99999`)
+
+	_, err = ParseFavourites(strings.NewReader(":7777"))
+	assert.EqualError(t, err, `line 1: address ":7777" is missing a host`)
+}
@@ -0,0 +1,79 @@
+package sampquery
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// QueryFile reads server addresses from the file at path, in any format ParseFavourites accepts, and
+// queries each with GetServerInfo, up to concurrency at once. Results and errors are keyed by address
+// as written in the file, with the port defaulted where missing. progress, if not nil, is called
+// after each server is done with how many are done out of the total, never concurrently. Entries
+// that aren't valid addresses aren't queried, their errors are keyed by the entry as written. If the
+// file itself can't be read the only error returned is keyed by path.
+func QueryFile(ctx context.Context, path string, concurrency int, progress func(done, total int), opts ...Option) (servers map[string]Server, errs map[string]error) {
+	servers = make(map[string]Server)
+	errs = make(map[string]error)
+
+	f, err := os.Open(path)
+	if err != nil {
+		errs[path] = err
+		return
+	}
+	defer f.Close()
+
+	entries, err := readFavourites(f)
+	if err != nil {
+		errs[path] = err
+		return
+	}
+	var addresses []string
+	for _, entry := range entries {
+		if entry.err != nil {
+			errs[entry.entry] = entry.err
+			continue
+		}
+		addresses = append(addresses, entry.address)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	hosts := make(chan string)
+	go func() {
+		defer close(hosts)
+		for _, address := range addresses {
+			hosts <- address
+		}
+	}()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hosts {
+				server, err := GetServerInfo(ctx, host, true, opts...)
+
+				mu.Lock()
+				if err != nil {
+					errs[host] = err
+				} else {
+					servers[host] = server
+				}
+				done++
+				if progress != nil {
+					progress(done, len(addresses))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return
+}
@@ -0,0 +1,70 @@
+package sampquery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryFile(t *testing.T) {
+	named := func(hostname string) map[QueryType]func(request []byte) []byte {
+		return map[QueryType]func(request []byte) []byte{
+			Info: func(request []byte) []byte {
+				return buildResponse(request, buildInfoPayload(false, 1, 50, hostname, "gamemode", "English"))
+			},
+		}
+	}
+	first := mockSAMPServer(t, named("first"))
+	second := mockSAMPServer(t, named("second"))
+	silent := mockServer(t, func(request []byte) []byte { return nil })
+
+	path := filepath.Join(t.TempDir(), "servers.txt")
+	err := os.WriteFile(path, []byte(strings.Join([]string{"# servers", first, second, silent}, "\n")), 0o600)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	var calls [][2]int
+	servers, errs := QueryFile(ctx, path, 2, func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+	})
+
+	assert.Len(t, servers, 2)
+	assert.Equal(t, "first", servers[first].Hostname)
+	assert.Equal(t, "second", servers[second].Hostname)
+	assert.Len(t, errs, 1)
+	assert.Error(t, errs[silent])
+	assert.Equal(t, [][2]int{{1, 3}, {2, 3}, {3, 3}}, calls)
+}
+
+func TestQueryFile_Missing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.txt")
+	servers, errs := QueryFile(context.Background(), path, 2, nil)
+	assert.Empty(t, servers)
+	assert.Len(t, errs, 1)
+	assert.Error(t, errs[path])
+}
+
+func TestQueryFile_InvalidEntry(t *testing.T) {
+	addr := mockSAMPServer(t, nil)
+
+	path := filepath.Join(t.TempDir(), "servers.txt")
+	err := os.WriteFile(path, []byte(addr+"\n127.0.0.1:99999\n"), 0o600)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the bad entry is reported on its own and doesn't stop the rest being queried
+	servers, errs := QueryFile(ctx, path, 2, nil)
+	assert.Len(t, servers, 1)
+	assert.Equal(t, "hostname", servers[addr].Hostname)
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs["127.0.0.1:99999"], `line 2: address "127.0.0.1:99999" has invalid port 99999`)
+}
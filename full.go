@@ -0,0 +1,56 @@
+package sampquery
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// FullServer is everything that can be queried from a server in one value, ready to be serialised
+// for a dashboard. The player list is named PlayerList as Server already has a Players count.
+type FullServer struct {
+	Server
+	PlayerList  []Player    `json:"player_list"`
+	ParsedRules CommonRules `json:"parsed_rules"`
+}
+
+// GetFullServer is GetServerInfo followed by the detailed player list, all over the one socket to
+// the one resolved address so the player list can't come from a different backend to the rest.
+// Servers with more players than the player limit don't send a reliable list, for those PlayerList
+// is left nil rather than failing the whole query.
+func GetFullServer(ctx context.Context, host string, attemptDecode bool, opts ...Option) (full FullServer, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%s: %w", host, err)
+		}
+	}()
+
+	query, err := NewQueryContext(ctx, host, opts...)
+	if err != nil {
+		return
+	}
+	query.reusePort = true
+	defer func() {
+		if e := query.Close(); e != nil && err == nil {
+			err = errors.Wrap(e, "failed to close socket")
+		}
+	}()
+
+	full.Server, err = query.getServerInfo(ctx, host, attemptDecode)
+	if err != nil {
+		return
+	}
+	full.ParsedRules = parseCommonRules(full.Rules)
+
+	if query.skipPassworded && full.Password {
+		return full, nil
+	}
+
+	query.Data = full.Server
+	full.PlayerList, err = query.GetDetailedPlayers(ctx)
+	if err == ErrTooManyPlayers {
+		return full, nil
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFullServer(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{
+				{"mapname", "San Andreas"},
+				{"version", "omp 1.2.0"},
+				{"weather", "10"},
+			}))
+		case Ping:
+			return buildResponse(request, request[11:])
+		case DetailedPlayers:
+			buf := new(bytes.Buffer)
+			binary.Write(buf, binary.LittleEndian, uint16(1))
+			buf.WriteByte(3)
+			buf.WriteByte(byte(len("Southclaws")))
+			buf.WriteString("Southclaws")
+			binary.Write(buf, binary.LittleEndian, int32(1337))
+			binary.Write(buf, binary.LittleEndian, int32(42))
+			return buildResponse(request, buf.Bytes())
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	full, err := GetFullServer(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", full.Hostname)
+	assert.Equal(t, 1, full.Players)
+	assert.True(t, full.IsOmp)
+	assert.Equal(t, []Player{{ID: 3, Name: "Southclaws", Score: 1337, Ping: 42}}, full.PlayerList)
+	assert.Equal(t, "San Andreas", full.ParsedRules.MapName)
+	assert.Equal(t, "omp 1.2.0", full.ParsedRules.Version)
+	assert.Equal(t, 10, full.ParsedRules.Weather)
+}
+
+// countingResolver resolves every host to loopback, counting the lookups.
+type countingResolver struct {
+	lookups int32
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func (r *countingResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
+
+func TestGetFullServer_OneConnection(t *testing.T) {
+	addr := mockSAMPServer(t, map[QueryType]func(request []byte) []byte{
+		DetailedPlayers: func(request []byte) []byte { return buildResponse(request, []byte{0, 0}) },
+	})
+	_, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+
+	var dials int32
+	dialer := WithDialer(func(addr *net.UDPAddr) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.DialUDP("udp", nil, addr)
+	})
+	resolver := &countingResolver{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	full, err := GetFullServer(ctx, net.JoinHostPort("samp.example.com", port), false, dialer, WithResolver(resolver))
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", full.Hostname)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&resolver.lookups))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
@@ -0,0 +1,72 @@
+package sampquery
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// healthLossSamples is how many pings GetHealth sends to measure packet loss.
+const healthLossSamples = 10
+
+// ServerHealth is a monitoring-focused summary of a server: whether it's up, how quickly and reliably
+// it answers, and which queries it answered.
+type ServerHealth struct {
+	Online bool          `json:"online"`
+	Ping   time.Duration `json:"ping"`
+	// PacketLoss is the fraction of pings, from 0 to 1, that went unanswered.
+	PacketLoss float64 `json:"packet_loss"`
+	// Answered records which of the ping, info, rules and players queries the server answered.
+	Answered map[QueryType]bool `json:"answered"`
+}
+
+// GetHealth pings the server at host and, if it answers, sends the info, rules and players queries
+// and measures packet loss concurrently, waiting until ctx is done for any that go unanswered. A
+// server that doesn't answer the ping is reported offline with total packet loss rather than as an
+// error, only failing to resolve host is an error.
+func GetHealth(ctx context.Context, host string, opts ...Option) (health ServerHealth, err error) {
+	query, err := NewQueryContext(ctx, host, opts...)
+	if err != nil {
+		return
+	}
+	defer query.Close()
+
+	health.Ping, err = query.GetPing(ctx)
+	health.Online = err == nil
+	health.Answered = query.Answered()
+	if !health.Online {
+		health.PacketLoss = 1
+		return health, nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		clones []*Query
+	)
+	run := func(fn func(clone *Query)) {
+		clone := query.Clone()
+		clones = append(clones, clone)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer clone.Close()
+			fn(clone)
+		}()
+	}
+
+	for _, opcode := range []QueryType{Info, Rules, Players} {
+		opcode := opcode
+		run(func(clone *Query) { clone.SendQuery(ctx, opcode) })
+	}
+	run(func(clone *Query) {
+		health.PacketLoss, _ = clone.MeasurePacketLoss(ctx, healthLossSamples)
+	})
+	wg.Wait()
+
+	for _, clone := range clones {
+		for opcode, ok := range clone.Answered() {
+			health.Answered[opcode] = ok
+		}
+	}
+	return health, nil
+}
@@ -0,0 +1,51 @@
+package sampquery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHealth(t *testing.T) {
+	var pings int32
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Ping:
+			// the first ping decides whether the server is online, drop two of the ten that follow
+			if n := atomic.AddInt32(&pings, 1); n == 3 || n == 4 {
+				return nil
+			}
+			return buildResponse(request, request[11:])
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Players:
+			return buildResponse(request, []byte{0, 0})
+		}
+		// rules go unanswered
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	health, err := GetHealth(ctx, addr)
+	assert.NoError(t, err)
+	assert.True(t, health.Online)
+	assert.True(t, health.Ping > 0)
+	assert.InDelta(t, 0.2, health.PacketLoss, 0.001)
+	assert.Equal(t, map[QueryType]bool{Ping: true, Info: true, Rules: false, Players: true}, health.Answered)
+}
+
+func TestGetHealth_Offline(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	health, err := GetHealth(ctx, addr)
+	assert.NoError(t, err)
+	assert.Equal(t, ServerHealth{PacketLoss: 1, Answered: map[QueryType]bool{Ping: false}}, health)
+}
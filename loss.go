@@ -0,0 +1,74 @@
+package sampquery
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MeasurePacketLoss sends samples ping queries at once, each with its own random token, and returns
+// the fraction of them, from 0 to 1, that weren't answered by the time ctx is done. Replies are
+// matched to pings by their token so duplicated replies aren't counted twice.
+func (query *Query) MeasurePacketLoss(ctx context.Context, samples int) (loss float64, err error) {
+	if samples < 1 {
+		return 0, errors.New("samples must be at least 1")
+	}
+
+	conn, err := query.openConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	pending := make(map[string]bool, samples)
+	for i := 0; i < samples; i++ {
+		request, err := query.BuildQueryPacket(Ping)
+		if err != nil {
+			return 0, err
+		}
+		pending[string(request[11:15])] = true
+		if _, err = conn.Write(request); err != nil {
+			return 0, errors.Wrap(err, "failed to write")
+		}
+	}
+
+	answered := make(chan int, 1)
+	query.beginRead()
+	go func() {
+		defer query.endRead()
+		count := 0
+		response := query.newReadBuffer(query.bufferSize)
+		conn.SetReadDeadline(time.Time{})
+		for count < samples {
+			n, errInner := conn.Read(response)
+			if errInner != nil {
+				break
+			}
+			if n < 15 || !query.hasMagic(response) || QueryType(response[10]) != Ping {
+				continue
+			}
+			if token := string(response[11:15]); pending[token] {
+				delete(pending, token)
+				count++
+			}
+		}
+		answered <- count
+	}()
+
+	var count int
+	select {
+	case count = <-answered:
+	case <-ctx.Done():
+		// stop the read and take whatever arrived in time
+		conn.SetReadDeadline(time.Now())
+		count = <-answered
+	}
+	// leave a reused connection ready for the next query
+	conn.SetReadDeadline(time.Time{})
+
+	if query.logger != nil {
+		query.logger.Debug("measured packet loss", "addr", query.addr, "sent", samples, "answered", count)
+	}
+	return float64(samples-count) / float64(samples), nil
+}
@@ -0,0 +1,35 @@
+package sampquery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery_MeasurePacketLoss(t *testing.T) {
+	var pings int32
+	addr := mockServer(t, func(request []byte) []byte {
+		// drop every other ping
+		if atomic.AddInt32(&pings, 1)%2 == 0 {
+			return nil
+		}
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	loss, err := query.MeasurePacketLoss(ctx, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, loss)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&pings))
+
+	_, err = query.MeasurePacketLoss(ctx, 0)
+	assert.EqualError(t, err, "samples must be at least 1")
+}
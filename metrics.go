@@ -0,0 +1,160 @@
+package sampquery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsBuckets are the upper bounds, in seconds, of the query duration histogram buckets.
+var metricsBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics counts queries and their outcomes and durations by opcode, for exposing to Prometheus
+// without depending on its client library. Attach it to queries with WithHooks(metrics.Hooks()) and
+// serve WritePrometheus from a metrics endpoint. A Metrics is safe for concurrent use.
+type Metrics struct {
+	mu      sync.Mutex
+	opcodes map[QueryType]*opcodeMetrics
+}
+
+type opcodeMetrics struct {
+	total     int
+	successes int
+	failures  map[string]int
+	// buckets counts the durations that fell into each bucket, not cumulatively
+	buckets []int
+	sum     float64
+}
+
+// NewMetrics creates an empty metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{opcodes: make(map[QueryType]*opcodeMetrics)}
+}
+
+// Hooks returns hooks which record every query they're attached to. To combine them with hooks of
+// your own, call Observe from your QueryEnd instead.
+func (m *Metrics) Hooks() Hooks {
+	return Hooks{
+		QueryEnd: func(ctx context.Context, opcode QueryType, duration time.Duration, err error) {
+			m.Observe(opcode, duration, err)
+		},
+	}
+}
+
+// Observe records a query for opcode which took duration and failed with err, or succeeded if err
+// is nil.
+func (m *Metrics) Observe(opcode QueryType, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	om, ok := m.opcodes[opcode]
+	if !ok {
+		om = &opcodeMetrics{
+			failures: make(map[string]int),
+			buckets:  make([]int, len(metricsBuckets)),
+		}
+		m.opcodes[opcode] = om
+	}
+
+	om.total++
+	if err == nil {
+		om.successes++
+	} else {
+		om.failures[failureReason(err)]++
+	}
+
+	seconds := duration.Seconds()
+	om.sum += seconds
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			om.buckets[i]++
+			break
+		}
+	}
+}
+
+// failureReason sorts a query error into a short label value.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrConnRefused):
+		return "refused"
+	case errors.Is(err, ErrTokenMismatch):
+		return "token_mismatch"
+	case errors.Is(err, ErrShortResponse):
+		return "short_response"
+	case errors.Is(err, ErrResponseTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrClosed):
+		return "closed"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	var netErr net.Error
+	if errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+	return "other"
+}
+
+// WritePrometheus writes every metric recorded so far to w in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	opcodes := make([]QueryType, 0, len(m.opcodes))
+	for opcode := range m.opcodes {
+		opcodes = append(opcodes, opcode)
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+
+	bw := bufio.NewWriter(w)
+	header := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("sampquery_queries_total", "counter", "Queries sent, by opcode.")
+	for _, opcode := range opcodes {
+		fmt.Fprintf(bw, "sampquery_queries_total{opcode=%q} %d\n", opcode.String(), m.opcodes[opcode].total)
+	}
+
+	header("sampquery_query_successes_total", "counter", "Queries answered, by opcode.")
+	for _, opcode := range opcodes {
+		fmt.Fprintf(bw, "sampquery_query_successes_total{opcode=%q} %d\n", opcode.String(), m.opcodes[opcode].successes)
+	}
+
+	header("sampquery_query_failures_total", "counter", "Queries that failed, by opcode and reason.")
+	for _, opcode := range opcodes {
+		failures := m.opcodes[opcode].failures
+		reasons := make([]string, 0, len(failures))
+		for reason := range failures {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(bw, "sampquery_query_failures_total{opcode=%q,reason=%q} %d\n", opcode.String(), reason, failures[reason])
+		}
+	}
+
+	header("sampquery_query_duration_seconds", "histogram", "How long queries took, by opcode.")
+	for _, opcode := range opcodes {
+		om := m.opcodes[opcode]
+		cumulative := 0
+		for i, bound := range metricsBuckets {
+			cumulative += om.buckets[i]
+			fmt.Fprintf(bw, "sampquery_query_duration_seconds_bucket{opcode=%q,le=%q} %d\n",
+				opcode.String(), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "sampquery_query_duration_seconds_bucket{opcode=%q,le=\"+Inf\"} %d\n", opcode.String(), om.total)
+		fmt.Fprintf(bw, "sampquery_query_duration_seconds_sum{opcode=%q} %s\n", opcode.String(), strconv.FormatFloat(om.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "sampquery_query_duration_seconds_count{opcode=%q} %d\n", opcode.String(), om.total)
+	}
+
+	return bw.Flush()
+}
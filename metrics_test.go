@@ -0,0 +1,72 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			// too short to even hold the header
+			return request[:5]
+		}
+		return nil
+	})
+
+	metrics := NewMetrics()
+	query, err := NewQuery(addr, WithHooks(metrics.Hooks()))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		_, err = query.GetInfo(ctx, false)
+		assert.NoError(t, err)
+	}
+	_, err = query.GetRules(ctx)
+	assert.Error(t, err)
+
+	pingCtx, pingCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer pingCancel()
+	_, err = query.GetPing(pingCtx)
+	assert.Equal(t, ErrTimeout, err)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, metrics.WritePrometheus(buf))
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE sampquery_queries_total counter\n",
+		`sampquery_queries_total{opcode="info"} 2` + "\n",
+		`sampquery_queries_total{opcode="rules"} 1` + "\n",
+		`sampquery_queries_total{opcode="ping"} 1` + "\n",
+		`sampquery_query_successes_total{opcode="info"} 2` + "\n",
+		`sampquery_query_successes_total{opcode="rules"} 0` + "\n",
+		`sampquery_query_failures_total{opcode="rules",reason="short_response"} 1` + "\n",
+		`sampquery_query_failures_total{opcode="ping",reason="timeout"} 1` + "\n",
+		"# TYPE sampquery_query_duration_seconds histogram\n",
+		`sampquery_query_duration_seconds_bucket{opcode="info",le="+Inf"} 2` + "\n",
+		`sampquery_query_duration_seconds_count{opcode="ping"} 1` + "\n",
+	} {
+		assert.Contains(t, out, line)
+	}
+	assert.NotContains(t, out, `sampquery_query_failures_total{opcode="info"`)
+}
+
+func TestFailureReason_Timeout(t *testing.T) {
+	assert.Equal(t, "timeout", failureReason(ErrTimeout))
+	assert.Equal(t, "timeout", failureReason(fmt.Errorf("%w after %d attempts", ErrTimeout, 3)))
+	// the message alone isn't enough to be counted as a timeout
+	assert.Equal(t, "other", failureReason(errors.New("handshake timed out")))
+}
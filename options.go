@@ -0,0 +1,363 @@
+package sampquery
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Option configures optional behaviour of a Query, pass them to NewQuery or GetServerInfo.
+type Option func(*Query)
+
+// options holds everything configurable via Option, it's embedded in Query and copied by Clone.
+type options struct {
+	bufferSize      int
+	magic           string
+	random          *randReader
+	maxResponseSize int
+	logger          *slog.Logger
+	dial            DialFunc
+	reusePort       bool
+	userConn        *net.UDPConn
+	hooks           Hooks
+	parallel        bool
+	clock           Clock
+
+	resolver       Resolver
+	resolveRetries int
+	resolveBackoff time.Duration
+
+	transformSend    func([]byte) []byte
+	transformReceive func([]byte) []byte
+
+	retries         int
+	retryBase       time.Duration
+	retryMultiplier float64
+
+	playerLimit    int
+	ompTimeout     time.Duration
+	noPlayerScores bool
+	maxRules       int
+	skipPassworded bool
+
+	languagePlaceholder string
+	pinnedEncodings     map[string]string
+	languageEncodings   map[string]string
+	rawFields           bool
+	trimWhitespace      bool
+	stripColors         bool
+}
+
+// DialFunc opens the connection a query is sent and received over. Each returned Read must yield
+// exactly one response packet, as a connected UDP socket does.
+type DialFunc func(addr *net.UDPAddr) (net.Conn, error)
+
+// Resolver looks up the addresses of the hosts queries are sent to, *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupPort(ctx context.Context, network, service string) (int, error)
+}
+
+// WithReadBufferSize sets the size of the buffer each response is read into. Every in-flight query
+// holds one of these, so a small buffer saves a lot of memory when scanning thousands of servers
+// concurrently. Any response larger than the buffer is truncated by the socket, so a response that
+// fills it is requested again with a buffer big enough for anything, costing an extra round trip.
+// GetPipelined and SendRCON don't do this and return what fitted. Defaults to the maximum UDP
+// payload size.
+func WithReadBufferSize(size int) Option {
+	return func(query *Query) {
+		if size > 0 {
+			query.bufferSize = size
+		}
+	}
+}
+
+// WithMagic sets the 4 byte magic every request starts with and every response is expected to
+// start with, for querying forks and private builds which use something other than the default of
+// "SAMP". Anything that isn't exactly 4 bytes is ignored.
+func WithMagic(magic string) Option {
+	return func(query *Query) {
+		if len(magic) == 4 {
+			query.magic = magic
+		}
+	}
+}
+
+// WithRandReader sets where the 4 random bytes appended to ping and open.mp check requests are read
+// from, so tests can assert exact packet bytes. Defaults to crypto/rand. Reads are serialised, so r
+// needn't be safe for concurrent use even though clones, such as those used by ProbeOpcodes and
+// GetHealth, share it.
+func WithRandReader(r io.Reader) Option {
+	return func(query *Query) {
+		query.random = &randReader{r: r}
+	}
+}
+
+// randReader guards the reader set with WithRandReader, which is shared by every clone of a query.
+type randReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+// ReadFull fills p from the reader, without another read being interleaved.
+func (r *randReader) ReadFull(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := io.ReadFull(r.r, p)
+	return err
+}
+
+// WithLogger enables debug level tracing of the protocol: every packet sent, response received and
+// parse step is logged to logger, along with the query's RequestID. Nothing is logged, or even
+// formatted, when no logger is set.
+func WithLogger(logger *slog.Logger) Option {
+	return func(query *Query) {
+		query.logger = logger
+	}
+}
+
+// WithDialer replaces the UDP dial used for every query with dial, allowing queries to be routed
+// through proxies or custom transports, or served entirely in-memory for tests.
+func WithDialer(dial DialFunc) Option {
+	return func(query *Query) {
+		query.dial = dial
+	}
+}
+
+// WithPlayerLimit sets the number of online players, as reported by GetInfo, above which GetPlayers
+// refuses to query the player list. Defaults to 100, the point at which SA:MP servers stop sending
+// it reliably. A limit of zero or less disables the check.
+func WithPlayerLimit(limit int) Option {
+	return func(query *Query) {
+		query.playerLimit = limit
+	}
+}
+
+// WithPlayerScores controls whether GetPlayers expects the 4 byte score after each name in the
+// player list. Some very old SA:MP server builds omit it, pass false to parse their lists, which are
+// otherwise misread from the second player onwards. Defaults to true.
+func WithPlayerScores(present bool) Option {
+	return func(query *Query) {
+		query.noPlayerScores = !present
+	}
+}
+
+// WithMaxRules caps the number of rules GetRules parses, any more in the response are ignored. This
+// stops a malicious server declaring thousands of rules from making a scanner build huge maps. Zero,
+// the default, means no cap.
+func WithMaxRules(max int) Option {
+	return func(query *Query) {
+		query.maxRules = max
+	}
+}
+
+// WithSkipPassworded makes GetServerInfo and GetFullServer stop once the info query shows the server
+// is password protected, returning just the info without sending the rest of the queries. Saves
+// round trips when scanning for open servers. With WithParallel the rules and ping are sent along
+// with the info, so only the queries after them are skipped.
+func WithSkipPassworded(skip bool) Option {
+	return func(query *Query) {
+		query.skipPassworded = skip
+	}
+}
+
+// WithOmpTimeout sets how long to wait for a reply to the open.mp check before deciding the server
+// is plain SA:MP, which never answers it. Defaults to one second, which may be too short on high
+// latency connections and get open.mp servers misdetected.
+func WithOmpTimeout(timeout time.Duration) Option {
+	return func(query *Query) {
+		if timeout > 0 {
+			query.ompTimeout = timeout
+		}
+	}
+}
+
+// WithLanguagePlaceholder sets the value GetInfo reports as the language when the server didn't
+// send one, or when decoding wasn't attempted. Defaults to "-" for display purposes, programmatic
+// consumers will probably prefer an empty string.
+func WithLanguagePlaceholder(placeholder string) Option {
+	return func(query *Query) {
+		query.languagePlaceholder = placeholder
+	}
+}
+
+// WithLanguageEncoding makes decoding use encoding for servers whose language field is lang, matched
+// case-insensitively, taking precedence over the built-in table. It covers languages the table doesn't
+// know and overrides ones it gets wrong for a community, an empty encoding falls back to charset
+// detection. Encoding is any name golang.org/x/text/htmlindex knows.
+func WithLanguageEncoding(lang, encoding string) Option {
+	return func(query *Query) {
+		if query.languageEncodings == nil {
+			query.languageEncodings = make(map[string]string)
+		}
+		query.languageEncodings[strings.ToLower(strings.TrimSpace(lang))] = encoding
+	}
+}
+
+// WithRawFields makes GetInfo and GetServerInfo also return the hostname, gamemode and language
+// exactly as the server sent them in Server's Raw fields, to compare against what they decoded to.
+func WithRawFields(enabled bool) Option {
+	return func(query *Query) {
+		query.rawFields = enabled
+	}
+}
+
+// WithTrimWhitespace makes GetInfo and GetServerInfo trim the hostname and gamemode and collapse any
+// run of whitespace inside them, such as the padding many servers use to line up their names, into a
+// single space. The raw fields from WithRawFields are left as sent.
+func WithTrimWhitespace(enabled bool) Option {
+	return func(query *Query) {
+		query.trimWhitespace = enabled
+	}
+}
+
+// WithStripColors makes GetInfo and GetServerInfo remove the {RRGGBB} colour codes servers embed in
+// their hostname and gamemode, for displaying them as plain text. The raw fields from WithRawFields
+// are left as sent.
+func WithStripColors(enabled bool) Option {
+	return func(query *Query) {
+		query.stripColors = enabled
+	}
+}
+
+// WithPinnedEncoding makes decoding use encoding whenever charset detection ranks a charset from
+// group among its best guesses. Detection on short fields often can't tell charsets apart and ranks
+// several equally, so pinning the encoding expected for a server community makes the output
+// predictable. The groups are "latin", "central-european", "cyrillic", "arabic", "greek", "hebrew",
+// "turkish", "japanese", "chinese" and "korean". Encoding is any name golang.org/x/text/htmlindex
+// knows.
+func WithPinnedEncoding(group, encoding string) Option {
+	return func(query *Query) {
+		if query.pinnedEncodings == nil {
+			query.pinnedEncodings = make(map[string]string)
+		}
+		query.pinnedEncodings[group] = encoding
+	}
+}
+
+// WithRetries resends a query up to retries times when no response arrives, which helps on lossy
+// links where UDP packets are dropped. Each attempt waits longer than the last, see WithRetryBackoff.
+// The open.mp check is never retried. Defaults to zero, a single attempt that waits on the context.
+func WithRetries(retries int) Option {
+	return func(query *Query) {
+		query.retries = retries
+	}
+}
+
+// WithRetryBackoff sets how long the first attempt at a query waits for a response before retrying,
+// and what each following attempt's wait is multiplied by. Defaults to 500ms doubling each time, so
+// 500ms, 1s, 2s and so on. Only used with WithRetries.
+func WithRetryBackoff(base time.Duration, multiplier float64) Option {
+	return func(query *Query) {
+		if base > 0 {
+			query.retryBase = base
+		}
+		if multiplier >= 1 {
+			query.retryMultiplier = multiplier
+		}
+	}
+}
+
+// WithResolver replaces net.DefaultResolver for looking up the host a query is created for.
+func WithResolver(resolver Resolver) Option {
+	return func(query *Query) {
+		query.resolver = resolver
+	}
+}
+
+// WithResolveRetries makes looking up the host retry up to retries times after a failure, waiting
+// base before the first retry and twice as long before each one after, for monitors that shouldn't
+// give up on a server over a DNS blip. Hosts that don't exist aren't retried, and the lookup still
+// fails as soon as the context is done. Disabled by default.
+func WithResolveRetries(retries int, base time.Duration) Option {
+	return func(query *Query) {
+		query.resolveRetries = retries
+		query.resolveBackoff = base
+	}
+}
+
+// WithSourcePortReuse controls whether every query is sent from the same source port over one
+// long-lived connection, which is then closed by Query.Close. The default, false, gives each query
+// a fresh ephemeral port, which avoids per-source-port rate limits when scanning. GetServerInfo
+// always sends its queries to a server over one connection, except in parallel.
+func WithSourcePortReuse(reuse bool) Option {
+	return func(query *Query) {
+		query.reusePort = reuse
+	}
+}
+
+// WithMaxResponseSize caps the size of response accepted from a server, anything larger fails with
+// ErrResponseTooLarge and only the cap plus one byte is ever buffered. This guards scanners against
+// malicious servers replying with huge responses to waste memory. Zero, the default, means no cap.
+func WithMaxResponseSize(size int) Option {
+	return func(query *Query) {
+		query.maxResponseSize = size
+	}
+}
+
+// WithConn sends every query over conn, which must already be connected to the server, instead of
+// dialling. The connection belongs to the caller: Query.Close won't close it and clones of the query
+// share it, so they must not be used concurrently.
+func WithConn(conn *net.UDPConn) Option {
+	return func(query *Query) {
+		query.userConn = conn
+	}
+}
+
+// WithParallel makes GetServerInfo send its info, rules and ping queries concurrently, each over
+// its own socket, which cuts the total time to roughly that of the slowest query. It has no effect
+// with WithConn, as a single connection can't be shared by concurrent queries.
+func WithParallel(parallel bool) Option {
+	return func(query *Query) {
+		query.parallel = parallel
+	}
+}
+
+// WithTransform passes every packet sent through send and every packet received through receive,
+// either of which may be nil. This allows queries to be routed through relays which expect a header
+// of their own or obfuscate the traffic. The packet passed to send must not be modified, return a
+// new slice instead. A received packet that grows past the read buffer fails the read with
+// io.ErrShortBuffer. Transforms aren't applied by GetPorts, which doesn't use a connected socket.
+func WithTransform(send, receive func([]byte) []byte) Option {
+	return func(query *Query) {
+		query.transformSend = send
+		query.transformReceive = receive
+	}
+}
+
+// Hooks are callbacks invoked around every query sent with SendQuery, which all of the Get methods
+// apart from GetPipelined and GetPorts use. They allow wiring in tracing spans or metrics without
+// this package depending on any particular library. Either may be nil.
+type Hooks struct {
+	// QueryStart is called before a query is sent. If it returns a context, that context is used
+	// for the rest of the query and passed to QueryEnd, so a span can be carried through.
+	QueryStart func(ctx context.Context, opcode QueryType) context.Context
+	// QueryEnd is called when a query finishes with how long it took and the error, if any.
+	QueryEnd func(ctx context.Context, opcode QueryType, duration time.Duration, err error)
+}
+
+// WithHooks sets callbacks to run at the start and end of every query.
+func WithHooks(hooks Hooks) Option {
+	return func(query *Query) {
+		query.hooks = hooks
+	}
+}
+
+// Clock tells the time. Query uses it to measure pings and query durations and to time stamp
+// results. Read deadlines are always set from the real time, as that's what sockets check them
+// against.
+type Clock interface {
+	Now() time.Time
+}
+
+// WithClock replaces the real clock, for tests that need pings, query durations and time stamps to
+// come out exactly.
+func WithClock(clock Clock) Option {
+	return func(query *Query) {
+		query.clock = clock
+	}
+}
@@ -0,0 +1,884 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithReadBufferSize(t *testing.T) {
+	var rules [][2]string
+	for i := 0; i < 100; i++ {
+		rules = append(rules, [2]string{fmt.Sprintf("rule_%03d", i), fmt.Sprintf("value_%03d", i)})
+	}
+	payload := buildRulesPayload(rules)
+
+	var requests int32
+	addr := mockServer(t, func(request []byte) []byte {
+		atomic.AddInt32(&requests, 1)
+		return buildResponse(request, payload)
+	})
+
+	tests := []struct {
+		name     string
+		size     int
+		requests int32
+	}{
+		// the truncated response fills the buffer, so it's requested again with a larger one
+		{"small", 512, 2},
+		// a response exactly the size of the buffer can't be told apart from a truncated one
+		{"exact", 11 + len(payload), 2},
+		{"large", 8192, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+
+			query, err := NewQuery(addr, WithReadBufferSize(tt.size))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			got, err := query.GetRules(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, got, len(rules))
+			assert.Equal(t, tt.requests, atomic.LoadInt32(&requests))
+		})
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildRulesPayload([][2]string{{"mapname", "San Andreas"}}))
+	})
+
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	query, err := NewQuery(addr, WithLogger(logger))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetRules(ctx)
+	assert.NoError(t, err)
+
+	output := buf.String()
+	assert.Contains(t, output, "sent query")
+	assert.Contains(t, output, "received response")
+	assert.Contains(t, output, "parsed rules")
+	assert.Contains(t, output, "declared=1 parsed=1")
+}
+
+func TestWithLogger_RulesTruncated(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		payload := buildRulesPayload([][2]string{{"mapname", "San Andreas"}, {"weather", "10"}})
+		binary.LittleEndian.PutUint16(payload, 5)
+		return buildResponse(request, payload)
+	})
+
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	query, err := NewQuery(addr, WithLogger(logger))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rules, err := query.GetRules(ctx)
+	assert.Equal(t, ErrRulesTruncated, err)
+	assert.Len(t, rules, 2)
+	assert.Contains(t, buf.String(), "level=WARN msg=\"rules response ended early\"")
+	assert.Contains(t, buf.String(), "declared=5 parsed=2")
+}
+
+func TestWithDialer(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		request := make([]byte, 64)
+		n, err := server.Read(request)
+		if err != nil {
+			return
+		}
+		server.Write(buildResponse(request[:n], buildInfoPayload(false, 7, 50, "in-memory", "gamemode", "English")))
+	}()
+
+	var dialled *net.UDPAddr
+	query, err := NewQuery("127.0.0.1:7777", WithDialer(func(addr *net.UDPAddr) (net.Conn, error) {
+		dialled = addr
+		return client, nil
+	}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	info, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "in-memory", info.Hostname)
+	assert.Equal(t, 7, info.Players)
+	assert.Equal(t, "127.0.0.1:7777", dialled.String())
+}
+
+func TestWithPlayerLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr error
+		queries int32
+	}{
+		{"default", nil, ErrTooManyPlayers, 0},
+		{"raised", []Option{WithPlayerLimit(200)}, nil, 1},
+		{"disabled", []Option{WithPlayerLimit(0)}, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var playerQueries int32
+			addr := mockServer(t, func(request []byte) []byte {
+				switch QueryType(request[10]) {
+				case Info:
+					return buildResponse(request, buildInfoPayload(false, 150, 200, "hostname", "gamemode", "English"))
+				case Players:
+					atomic.AddInt32(&playerQueries, 1)
+					return buildResponse(request, buildPlayersPayload([]string{"Southclaws"}, []int32{0}))
+				}
+				return nil
+			})
+
+			query, err := NewQuery(addr, tt.opts...)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			_, err = query.GetInfo(ctx, false)
+			assert.NoError(t, err)
+
+			_, err = query.GetPlayers(ctx)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.queries, atomic.LoadInt32(&playerQueries))
+		})
+	}
+}
+
+func TestWithOmpTimeout(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		if QueryType(request[10]) != IsOmp {
+			return nil
+		}
+		time.Sleep(1500 * time.Millisecond)
+		return buildResponse(request, request[11:])
+	})
+
+	tests := []struct {
+		name string
+		opts []Option
+		want bool
+	}{
+		{"default", nil, false},
+		{"extended", []Option{WithOmpTimeout(3 * time.Second)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := NewQuery(addr, tt.opts...)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			assert.Equal(t, tt.want, query.GetOmpValidity(ctx))
+		})
+	}
+}
+
+func TestWithLanguagePlaceholder(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 0, 50, "hostname", "gamemode", ""))
+	})
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "-"},
+		{"empty", []Option{WithLanguagePlaceholder("")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := NewQuery(addr, tt.opts...)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, true)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, server.Language)
+		})
+	}
+}
+
+func TestWithSourcePortReuse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	sources := make(chan int, 10)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- from.Port
+			conn.WriteToUDP(buildResponse(buf[:n], buf[11:n]), from)
+		}
+	}()
+
+	tests := []struct {
+		reuse    bool
+		wantSame bool
+	}{
+		{false, false},
+		{true, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.reuse), func(t *testing.T) {
+			query, err := NewQuery(conn.LocalAddr().String(), WithSourcePortReuse(tt.reuse))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			var ports []int
+			for i := 0; i < 3; i++ {
+				_, err = query.GetPing(ctx)
+				assert.NoError(t, err)
+				ports = append(ports, <-sources)
+			}
+			assert.Equal(t, tt.wantSame, ports[0] == ports[1] && ports[1] == ports[2], "source ports %v", ports)
+
+			assert.NoError(t, query.Close())
+			assert.NoError(t, query.Close())
+		})
+	}
+}
+
+func TestWithMaxResponseSize(t *testing.T) {
+	var rules [][2]string
+	for i := 0; i < 50; i++ {
+		rules = append(rules, [2]string{fmt.Sprintf("rule_%03d", i), fmt.Sprintf("value_%03d", i)})
+	}
+	payload := buildRulesPayload(rules)
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"uncapped", 0, false},
+		{"roomy", 4096, false},
+		{"exact", len(payload) + 11, false},
+		{"oversized", 256, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := NewQuery(addr, WithMaxResponseSize(tt.size))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			got, err := query.GetRules(ctx)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrResponseTooLarge))
+				assert.EqualError(t, err, "response too large: over 256 bytes")
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, got, len(rules))
+			}
+		})
+	}
+}
+
+func TestWithConn(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 2, 50, "hostname", "gamemode", "English"))
+	})
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	assert.NoError(t, err)
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	query, err := NewQuery(addr, WithConn(conn))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.NoError(t, query.Close())
+
+	// the connection should still be open and usable by another query
+	query, err = NewQuery(addr, WithConn(conn))
+	assert.NoError(t, err)
+	server, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.Players)
+}
+
+func TestWithHooks(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			time.Sleep(10 * time.Millisecond)
+			return buildResponse(request, buildInfoPayload(false, 0, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return request[:5]
+		}
+		return nil
+	})
+
+	type hookKey struct{}
+	type call struct {
+		opcode   QueryType
+		duration time.Duration
+		err      error
+		span     interface{}
+	}
+	var started []QueryType
+	var ended []call
+
+	query, err := NewQuery(addr, WithHooks(Hooks{
+		QueryStart: func(ctx context.Context, opcode QueryType) context.Context {
+			started = append(started, opcode)
+			return context.WithValue(ctx, hookKey{}, "span")
+		},
+		QueryEnd: func(ctx context.Context, opcode QueryType, duration time.Duration, err error) {
+			ended = append(ended, call{opcode, duration, err, ctx.Value(hookKey{})})
+		},
+	}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	_, err = query.GetRules(ctx)
+	assert.Error(t, err)
+
+	assert.Equal(t, []QueryType{Info, Rules}, started)
+	assert.Len(t, ended, 2)
+	assert.Equal(t, Info, ended[0].opcode)
+	assert.True(t, ended[0].duration >= 10*time.Millisecond, "duration %v", ended[0].duration)
+	assert.NoError(t, ended[0].err)
+	assert.Equal(t, "span", ended[0].span)
+	assert.Equal(t, Rules, ended[1].opcode)
+	assert.True(t, errors.Is(ended[1].err, ErrShortResponse))
+}
+
+func TestWithPlayerScores(t *testing.T) {
+	// a player list as sent by old server builds: a count then names, with no scores
+	payload := []byte{2, 0}
+	for _, name := range []string{"Southclaws", "Y_Less"} {
+		payload = append(payload, byte(len(name)))
+		payload = append(payload, name...)
+	}
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr, WithPlayerScores(false))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	players, err := query.GetPlayers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Southclaws", "Y_Less"}, players)
+
+	query, err = NewQuery(addr)
+	assert.NoError(t, err)
+
+	_, err = query.GetPlayers(ctx)
+	assert.Error(t, err)
+}
+
+func TestWithMaxRules(t *testing.T) {
+	var rules [][2]string
+	for i := 0; i < 10; i++ {
+		rules = append(rules, [2]string{fmt.Sprintf("rule%d", i), "value"})
+	}
+	payload := buildRulesPayload(rules)
+	// declare far more rules than are sent
+	binary.LittleEndian.PutUint16(payload, 65535)
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr, WithMaxRules(5))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	parsed, err := query.GetRules(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, parsed, 5)
+}
+
+func TestWithMagic(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		response := buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		copy(response, "OMPX")
+		return response
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	query, err := NewQuery(addr, WithMagic("OMPX"))
+	assert.NoError(t, err)
+
+	packet, err := query.BuildQueryPacket(Info)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("OMPX"), packet[:4])
+
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+
+	query, err = NewQuery(addr)
+	assert.NoError(t, err)
+
+	_, err = query.GetInfo(ctx, false)
+	assert.EqualError(t, err, `response has magic "OMPX", expected "SAMP"`)
+}
+
+func TestWithPinnedEncoding(t *testing.T) {
+	// too short for chardet to tell apart, it ranks Shift_JIS, GB-18030, EUC-JP, EUC-KR and Big5 equally
+	input := []byte{0xd1, 0xe5, 0xf0, 0xe2, 0xe5, 0xf0}
+
+	query, err := NewQuery("127.0.0.1:7777", WithPinnedEncoding("korean", "euc-kr"))
+	assert.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		_, charset := query.attemptDecodeANSI(input, input, "")
+		assert.Equal(t, "euc-kr", charset)
+	}
+
+	// a pin for a group that wasn't detected changes nothing, chardet still picks one of its guesses
+	query, err = NewQuery("127.0.0.1:7777", WithPinnedEncoding("greek", "windows-1253"))
+	assert.NoError(t, err)
+
+	_, charset := query.attemptDecodeANSI(input, input, "")
+	assert.NotEqual(t, "windows-1253", charset)
+}
+
+func TestWithLanguageEncoding(t *testing.T) {
+	// "สวัสดี" in windows-874
+	input := []byte{0xca, 0xc7, 0xd1, 0xca, 0xb4, 0xd5}
+
+	query, err := NewQuery("127.0.0.1:7777", WithLanguageEncoding("thai", "windows-874"))
+	assert.NoError(t, err)
+
+	decoded, charset := query.attemptDecodeANSI(input, input, "Thai")
+	assert.Equal(t, "สวัสดี", decoded)
+	assert.Equal(t, "windows-874", charset)
+
+	// overrides merge over the built-in table rather than replacing it
+	assert.Equal(t, "windows-1251", query.encodingForLanguage("russian"))
+
+	query, err = NewQuery("127.0.0.1:7777", WithLanguageEncoding("Russian", "koi8-r"))
+	assert.NoError(t, err)
+	assert.Equal(t, "koi8-r", query.encodingForLanguage("russian"))
+}
+
+func TestWithRawFields(t *testing.T) {
+	// "Русский сервер" in windows-1251
+	hostname := "\xd0\xf3\xf1\xf1\xea\xe8\xe9 \xf1\xe5\xf0\xe2\xe5\xf0"
+	response := append(make([]byte, 11), buildInfoPayload(false, 1, 50, hostname, "roleplay", "Russian")...)
+
+	query, err := NewQuery("127.0.0.1:7777", WithRawFields(true))
+	assert.NoError(t, err)
+
+	server, err := query.parseInfo(response, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Русский сервер", server.Hostname)
+	assert.Equal(t, []byte(hostname), server.RawHostname)
+	assert.Equal(t, []byte("roleplay"), server.RawGamemode)
+	assert.Equal(t, []byte("Russian"), server.RawLanguage)
+
+	// they're copies, not views into the response buffer
+	response[15+4] = 'X'
+	assert.Equal(t, []byte(hostname), server.RawHostname)
+
+	query, err = NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	server, err = query.parseInfo(response, true)
+	assert.NoError(t, err)
+	assert.Nil(t, server.RawHostname)
+	assert.Nil(t, server.RawGamemode)
+	assert.Nil(t, server.RawLanguage)
+}
+
+func TestWithTrimWhitespace(t *testing.T) {
+	hostname := "   [EN]  Freeroam \t Stunts   "
+	response := append(make([]byte, 11), buildInfoPayload(false, 1, 50, hostname, " freeroam ", "English")...)
+
+	query, err := NewQuery("127.0.0.1:7777", WithTrimWhitespace(true), WithRawFields(true))
+	assert.NoError(t, err)
+
+	for _, attemptDecode := range []bool{false, true} {
+		server, err := query.parseInfo(response, attemptDecode)
+		assert.NoError(t, err)
+		assert.Equal(t, "[EN] Freeroam Stunts", server.Hostname)
+		assert.Equal(t, "freeroam", server.Gamemode)
+		assert.Equal(t, []byte(hostname), server.RawHostname)
+	}
+
+	query, err = NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	server, err := query.parseInfo(response, false)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, server.Hostname)
+}
+
+func TestWithStripColors(t *testing.T) {
+	hostname := "{FF0000}Red {00ff00}Green {nothex}"
+	response := append(make([]byte, 11), buildInfoPayload(false, 1, 50, hostname, "{FFFFFF}freeroam", "English")...)
+
+	query, err := NewQuery("127.0.0.1:7777", WithStripColors(true), WithRawFields(true))
+	assert.NoError(t, err)
+
+	server, err := query.parseInfo(response, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Red Green {nothex}", server.Hostname)
+	assert.Equal(t, "freeroam", server.Gamemode)
+	assert.Equal(t, []byte(hostname), server.RawHostname)
+
+	query, err = NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	server, err = query.parseInfo(response, true)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, server.Hostname)
+	assert.Equal(t, "{FFFFFF}freeroam", server.Gamemode)
+}
+
+func TestWithSkipPassworded(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent []QueryType
+	)
+	addr := mockServer(t, func(request []byte) []byte {
+		mu.Lock()
+		sent = append(sent, QueryType(request[10]))
+		mu.Unlock()
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(true, 1, 50, "hostname", "gamemode", "English"))
+		case DetailedPlayers:
+			return buildResponse(request, []byte{0, 0})
+		}
+		return sampReply(request)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := GetServerInfo(ctx, addr, false, WithSkipPassworded(true))
+	assert.NoError(t, err)
+	assert.True(t, server.Password)
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.Nil(t, server.Rules)
+	assert.Equal(t, map[QueryType]bool{Info: true}, server.Answered)
+
+	full, err := GetFullServer(ctx, addr, false, WithSkipPassworded(true))
+	assert.NoError(t, err)
+	assert.Nil(t, full.PlayerList)
+
+	mu.Lock()
+	assert.Equal(t, []QueryType{Info, Info}, sent)
+	sent = nil
+	mu.Unlock()
+
+	// without the option everything is sent as usual
+	_, err = GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []QueryType{Info, Rules, Ping}, sent)
+}
+
+// fakeClock is a Clock which only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	addr := mockServer(t, func(request []byte) []byte {
+		clock.Advance(42 * time.Millisecond)
+		return buildResponse(request, request[11:])
+	})
+
+	var took time.Duration
+	query, err := NewQuery(addr, WithClock(clock), WithHooks(Hooks{
+		QueryEnd: func(ctx context.Context, opcode QueryType, duration time.Duration, err error) {
+			took = duration
+		},
+	}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ping, err := query.GetPing(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 42*time.Millisecond, ping)
+	assert.Equal(t, 42*time.Millisecond, took)
+
+	millis, err := query.GetPingMillis(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, millis)
+}
+
+func TestWithClock_Deadlines(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case IsOmp:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	// a clock stuck far in the past mustn't put read deadlines in the past too
+	query, err := NewQuery(addr, WithClock(&fakeClock{now: time.Unix(0, 0)}), WithRetries(2))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.True(t, query.GetOmpValidity(ctx))
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+}
+
+// flakyResolver fails the first failures lookups of a host, then resolves it to loopback.
+type flakyResolver struct {
+	failures int
+	lookups  int
+	err      error
+}
+
+func (r *flakyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	if r.lookups <= r.failures {
+		return nil, r.err
+	}
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func (r *flakyResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
+
+func TestWithResolveRetries(t *testing.T) {
+	temporary := &net.DNSError{Err: "server misbehaving", Name: "samp.example.com", IsTemporary: true}
+
+	resolver := &flakyResolver{failures: 2, err: temporary}
+	start := time.Now()
+	query, err := NewQuery("samp.example.com:7777", WithResolver(resolver), WithResolveRetries(3, 20*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7777", query.addr.String())
+	assert.Equal(t, 3, resolver.lookups)
+	// waited 20ms then 40ms
+	assert.True(t, time.Since(start) >= 60*time.Millisecond, "took %s", time.Since(start))
+
+	// without retries the first failure is final
+	resolver = &flakyResolver{failures: 2, err: temporary}
+	_, err = NewQuery("samp.example.com:7777", WithResolver(resolver))
+	assert.Error(t, err)
+	assert.Equal(t, 1, resolver.lookups)
+
+	// a host that doesn't exist isn't worth retrying
+	resolver = &flakyResolver{failures: 2, err: &net.DNSError{Err: "no such host", Name: "samp.example.com", IsNotFound: true}}
+	_, err = NewQuery("samp.example.com:7777", WithResolver(resolver), WithResolveRetries(3, 20*time.Millisecond))
+	assert.Error(t, err)
+	assert.Equal(t, 1, resolver.lookups)
+
+	// the context bounds the retries
+	resolver = &flakyResolver{failures: 10, err: temporary}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = NewQueryContext(ctx, "samp.example.com:7777", WithResolver(resolver), WithResolveRetries(10, 20*time.Millisecond))
+	assert.Error(t, err)
+	assert.True(t, resolver.lookups < 4, "%d lookups", resolver.lookups)
+}
+
+func TestWithRandReader(t *testing.T) {
+	query, err := NewQuery("192.168.1.20:7777", WithRandReader(bytes.NewReader([]byte{1, 2, 3, 4, 5, 6, 7, 8})))
+	assert.NoError(t, err)
+
+	packet, err := query.BuildQueryPacket(Ping)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'S', 'A', 'M', 'P', 192, 168, 1, 20, 0x61, 0x1e, 'p', 1, 2, 3, 4}, packet)
+
+	packet, err = query.BuildQueryPacket(IsOmp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'S', 'A', 'M', 'P', 192, 168, 1, 20, 0x61, 0x1e, 'o', 5, 6, 7, 8}, packet)
+
+	// the reader is exhausted now
+	_, err = query.BuildQueryPacket(Ping)
+	assert.EqualError(t, err, "failed to generate random bytes: EOF")
+}
+
+func TestWithRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		multiplier float64
+		wantErr    string
+	}{
+		{"growing", 2, ""},
+		{"fixed", 1, "socket read timed out after 3 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				arrivals []time.Time
+			)
+			addr := mockServer(t, func(request []byte) []byte {
+				mu.Lock()
+				arrivals = append(arrivals, time.Now())
+				count := len(arrivals)
+				mu.Unlock()
+				if count < 3 {
+					return nil
+				}
+				// only answers the last attempt, and slower than the first attempt's timeout
+				time.Sleep(150 * time.Millisecond)
+				return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+			})
+
+			query, err := NewQuery(addr, WithRetries(2), WithRetryBackoff(50*time.Millisecond, tt.multiplier))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, false)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.True(t, errors.Is(err, ErrTimeout))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "hostname", server.Hostname)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Len(t, arrivals, 3)
+			first, second := arrivals[1].Sub(arrivals[0]), arrivals[2].Sub(arrivals[1])
+			assert.True(t, second > first+30*time.Millisecond, "waited %s then %s", first, second)
+		})
+	}
+}
+
+func TestWithTransform(t *testing.T) {
+	xor := func(packet []byte) []byte {
+		out := make([]byte, len(packet))
+		for i, b := range packet {
+			out[i] = b ^ 0x5a
+		}
+		return out
+	}
+
+	// a relay which only speaks the obfuscated protocol
+	addr := mockServer(t, func(request []byte) []byte {
+		request = xor(request)
+		if string(request[:4]) != "SAMP" {
+			return nil
+		}
+		return xor(buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English")))
+	})
+
+	query, err := NewQuery(addr, WithTransform(xor, xor))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+}
+
+func TestWithTransform_ShortBuffer(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+	})
+
+	// a receive transform which pads the packet past the end of any read buffer
+	grow := func(packet []byte) []byte {
+		return append(packet, make([]byte, 1<<16)...)
+	}
+	query, err := NewQuery(addr, WithTransform(nil, grow))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.True(t, errors.Is(err, io.ErrShortBuffer), "got %v", err)
+}
@@ -0,0 +1,78 @@
+package sampquery
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// getParallel fetches the info, rules and ping for GetServerInfo concurrently, each from its own
+// clone of the query so they don't share a socket. The first to fail stops the others. When several
+// fail, the error from the earliest of info, rules and ping is returned, so the result matches what
+// getSequential would give, with those stopped early reporting the error that stopped them.
+func (query *Query) getParallel(ctx context.Context, attemptDecode bool) (server Server, ping time.Duration, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg                         sync.WaitGroup
+		mu                         sync.Mutex
+		cause                      error
+		rules                      map[string]string
+		infoErr, rulesErr, pingErr error
+	)
+
+	var clones []*Query
+	run := func(result *error, fn func(clone *Query) error) {
+		clone := query.Clone()
+		clones = append(clones, clone)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer clone.Close()
+			err := fn(clone)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil || err == ErrRulesTruncated:
+			case cause != nil:
+				err = cause
+			default:
+				cause = err
+				cancel()
+			}
+			*result = err
+		}()
+	}
+
+	run(&infoErr, func(clone *Query) (err error) {
+		server, err = clone.GetInfo(ctx, attemptDecode)
+		return
+	})
+	run(&rulesErr, func(clone *Query) (err error) {
+		rules, err = clone.GetRules(ctx)
+		return
+	})
+	run(&pingErr, func(clone *Query) (err error) {
+		ping, err = clone.GetPing(ctx)
+		return
+	})
+	wg.Wait()
+
+	for _, clone := range clones {
+		for opcode, ok := range clone.Answered() {
+			query.recordAnswered(opcode, ok)
+		}
+	}
+
+	if infoErr != nil {
+		return server, 0, infoErr
+	}
+	query.Data = server
+
+	server.Rules = rules
+	if rulesErr != nil && rulesErr != ErrRulesTruncated {
+		return server, 0, rulesErr
+	}
+	return server, ping, pingErr
+}
@@ -0,0 +1,71 @@
+package sampquery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowConn delays every read, standing in for a high latency link
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Read(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Read(b)
+}
+
+func TestWithParallel(t *testing.T) {
+	addr := mockSAMPServer(t, nil)
+
+	slow := WithDialer(func(addr *net.UDPAddr) (net.Conn, error) {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return nil, err
+		}
+		return slowConn{conn, 100 * time.Millisecond}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	sequential, err := GetServerInfo(ctx, addr, false, slow)
+	assert.NoError(t, err)
+	sequentialTime := time.Since(start)
+
+	start = time.Now()
+	parallel, err := GetServerInfo(ctx, addr, false, slow, WithParallel(true))
+	assert.NoError(t, err)
+	parallelTime := time.Since(start)
+
+	// the ping and completion time are measured so will differ slightly between the two
+	sequential.Ping, parallel.Ping = 0, 0
+	sequential.QueriedAt, parallel.QueriedAt = time.Time{}, time.Time{}
+	assert.Equal(t, sequential, parallel)
+	assert.True(t, parallelTime < sequentialTime/2, "parallel %s, sequential %s", parallelTime, sequentialTime)
+}
+
+func TestWithParallel_StopsOnError(t *testing.T) {
+	// info fails straight away, rules and ping are never answered
+	addr := mockServer(t, func(request []byte) []byte {
+		if QueryType(request[10]) == Info {
+			return buildResponse(request, []byte{0, 1})
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := GetServerInfo(ctx, addr, false, WithParallel(true))
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "timed out")
+	assert.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+}
@@ -0,0 +1,108 @@
+package sampquery
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GetPipelined fetches the info, rules and players of a server over a single socket. All three
+// requests are written back-to-back before anything is read and the responses are matched up by
+// their opcode as they arrive, so the whole exchange costs roughly one round trip instead of three.
+// As with GetPlayers, a server with more players than the player limit isn't waited on for its
+// player list, the info and rules are returned along with ErrTooManyPlayers instead.
+func (query *Query) GetPipelined(ctx context.Context, attemptDecode bool) (server Server, players []string, err error) {
+	responses, err := query.sendPipelined(ctx, Info, Rules, Players)
+	if err != nil {
+		return
+	}
+
+	server, err = query.parseInfo(responses[Info], attemptDecode)
+	if err != nil {
+		return
+	}
+
+	server.Rules, err = query.parseRules(responses[Rules])
+	if err != nil && err != ErrRulesTruncated {
+		return
+	}
+
+	if query.playerLimit > 0 && server.Players > query.playerLimit {
+		return server, nil, ErrTooManyPlayers
+	}
+	players, err = query.parsePlayers(responses[Players])
+	return
+}
+
+// sendPipelined writes a request for each opcode then waits for a response to every one of them.
+func (query *Query) sendPipelined(ctx context.Context, opcodes ...QueryType) (responses map[QueryType][]byte, err error) {
+	conn, err := query.openConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	pending := make(map[QueryType]bool)
+	for _, opcode := range opcodes {
+		request, err := query.BuildQueryPacket(opcode)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(request); err != nil {
+			return nil, errors.Wrap(err, "failed to write")
+		}
+		pending[opcode] = true
+	}
+
+	type resultData struct {
+		responses map[QueryType][]byte
+		err       error
+	}
+	waitResult := make(chan resultData, 1)
+
+	query.beginRead()
+	go func() {
+		defer query.endRead()
+		responses := make(map[QueryType][]byte)
+		for len(pending) > 0 {
+			response := query.newReadBuffer(query.bufferSize)
+			n, errInner := conn.Read(response)
+			if errInner != nil {
+				waitResult <- resultData{err: readError(errInner)}
+				return
+			}
+			if n >= 11 {
+				query.recordBytesRead(QueryType(response[10]), n)
+			}
+			if errInner = query.checkResponseSize(n); errInner != nil {
+				waitResult <- resultData{err: errInner}
+				return
+			}
+			if n < 11 || !query.hasMagic(response) || echoedPort(response) != query.addr.Port || !pending[QueryType(response[10])] {
+				continue
+			}
+			responses[QueryType(response[10])] = response[:n]
+			delete(pending, QueryType(response[10]))
+			// the player list of a server over the limit is unreliable or never sent at all
+			if QueryType(response[10]) == Info && n >= 16 && query.playerLimit > 0 {
+				if players := int(binary.LittleEndian.Uint16(response[12:14])); players > query.playerLimit {
+					delete(pending, Players)
+				}
+			}
+		}
+		waitResult <- resultData{responses: responses}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// stop the read so it doesn't swallow responses meant for the next query on a reused socket
+		conn.SetReadDeadline(time.Now())
+		<-waitResult
+		conn.SetReadDeadline(time.Time{})
+		return nil, ErrTimeout
+	case result := <-waitResult:
+		return result.responses, result.err
+	}
+}
@@ -0,0 +1,97 @@
+package sampquery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery_GetPipelined(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(true, 2, 100, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"mapname", "San Andreas"}, {"version", "0.3.7"}}))
+		case Players:
+			return buildResponse(request, buildPlayersPayload([]string{"Southclaws", "Y_Less"}, []int32{10, 20}))
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	wantServer, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	wantServer.Rules, err = query.GetRules(ctx)
+	assert.NoError(t, err)
+	wantPlayers, err := query.GetPlayers(ctx)
+	assert.NoError(t, err)
+
+	gotServer, gotPlayers, err := query.GetPipelined(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, wantServer, gotServer)
+	assert.Equal(t, wantPlayers, gotPlayers)
+	assert.Equal(t, []string{"Southclaws", "Y_Less"}, gotPlayers)
+}
+
+func TestQuery_GetPipelined_TimeoutReusedConn(t *testing.T) {
+	var answering atomic.Bool
+	addr := mockServer(t, func(request []byte) []byte {
+		if !answering.Load() || QueryType(request[10]) != Info {
+			return nil
+		}
+		return buildResponse(request, buildInfoPayload(false, 2, 100, "hostname", "gamemode", "English"))
+	})
+
+	query, err := NewQuery(addr, WithSourcePortReuse(true))
+	assert.NoError(t, err)
+	defer query.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = query.GetPipelined(ctx, false)
+	assert.EqualError(t, err, "socket read timed out")
+
+	// the timed out read must not be left on the socket to swallow this response
+	answering.Store(true)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+}
+
+func TestQuery_GetPipelined_TooManyPlayers(t *testing.T) {
+	// the server is over the player limit and doesn't answer the player list at all
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 150, 200, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"weather", "10"}}))
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	server, players, err := query.GetPipelined(ctx, false)
+	assert.Equal(t, ErrTooManyPlayers, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "took %s", time.Since(start))
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.Equal(t, map[string]string{"weather": "10"}, server.Rules)
+	assert.Nil(t, players)
+}
@@ -0,0 +1,127 @@
+package sampquery
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// GetPorts queries the info and rules of the servers running on each of the given ports of the
+// query's IP address over a single socket. Hosting providers commonly run many servers on one IP so
+// this saves a socket per server when scanning a port range. Servers that haven't answered their
+// info query by the time ctx is done, or whose info response can't be parsed, are simply left out
+// of the result. A server whose rules response can't be parsed is returned without rules.
+func (query *Query) GetPorts(ctx context.Context, ports []int, attemptDecode bool) (servers map[int]Server, err error) {
+	select {
+	case <-query.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen")
+	}
+	defer conn.Close()
+
+	queries := make(map[int]*Query)
+	for _, port := range ports {
+		portQuery := query.Clone()
+		portQuery.addr.Port = port
+		queries[port] = portQuery
+
+		for _, opcode := range []QueryType{Info, Rules} {
+			request, err := portQuery.BuildQueryPacket(opcode)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = conn.WriteToUDP(request, portQuery.addr); err != nil {
+				return nil, errors.Wrap(err, "failed to write")
+			}
+		}
+	}
+
+	type packet struct {
+		port int
+		data []byte
+	}
+	packets := make(chan packet)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			response := make([]byte, query.bufferSize)
+			n, from, errInner := conn.ReadFromUDP(response)
+			if errInner != nil {
+				return
+			}
+			// the socket isn't connected, so anyone can send to it
+			if !from.IP.Equal(query.addr.IP) {
+				continue
+			}
+			select {
+			case packets <- packet{port: from.Port, data: response[:n]}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	responses := make(map[int]map[QueryType][]byte)
+	remaining := 2 * len(queries)
+	for remaining > 0 {
+		var p packet
+		select {
+		case <-ctx.Done():
+			remaining = 0
+			continue
+		case p = <-packets:
+		}
+
+		if queries[p.port] == nil || len(p.data) < 11 || !query.hasMagic(p.data) || echoedPort(p.data) != p.port {
+			continue
+		}
+		opcode := QueryType(p.data[10])
+		if opcode != Info && opcode != Rules {
+			continue
+		}
+		if responses[p.port] == nil {
+			responses[p.port] = make(map[QueryType][]byte)
+		}
+		if responses[p.port][opcode] == nil {
+			responses[p.port][opcode] = p.data
+			remaining--
+		}
+	}
+
+	servers = make(map[int]Server)
+	for port, response := range responses {
+		if response[Info] == nil {
+			continue
+		}
+		server, err := queries[port].parseInfo(response[Info], attemptDecode)
+		if err != nil {
+			// one bad server shouldn't lose the results of every other port in the batch
+			if query.logger != nil {
+				query.logger.Debug("skipping port with malformed info response", "addr", queries[port].addr, "error", err)
+			}
+			continue
+		}
+		server.Address = net.JoinHostPort(query.addr.IP.String(), strconv.Itoa(port))
+		server.ResolvedAddress = queries[port].addr.String()
+		if response[Rules] != nil {
+			if server.Rules, err = queries[port].parseRules(response[Rules]); err != nil && err != ErrRulesTruncated {
+				if query.logger != nil {
+					query.logger.Debug("ignoring malformed rules response", "addr", queries[port].addr, "error", err)
+				}
+				server.Rules = nil
+			}
+		}
+		servers[port] = server
+	}
+
+	return servers, nil
+}
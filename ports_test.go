@@ -0,0 +1,98 @@
+package sampquery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery_GetPorts(t *testing.T) {
+	var ports []int
+	for _, hostname := range []string{"first", "second"} {
+		hostname := hostname
+		addr := mockServer(t, func(request []byte) []byte {
+			switch QueryType(request[10]) {
+			case Info:
+				return buildResponse(request, buildInfoPayload(false, 1, 50, hostname, "gamemode", "English"))
+			case Rules:
+				return buildResponse(request, buildRulesPayload([][2]string{{"hostname", hostname}}))
+			}
+			return nil
+		})
+		_, port, err := net.SplitHostPort(addr)
+		assert.NoError(t, err)
+		p, err := strconv.Atoi(port)
+		assert.NoError(t, err)
+		ports = append(ports, p)
+	}
+
+	// a port answering with a truncated info response, it should be left out without failing the rest
+	malformed := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, []byte{0, 1})
+	})
+	_, port, err := net.SplitHostPort(malformed)
+	assert.NoError(t, err)
+	malformedPort, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+
+	// a port nobody is listening on, it should be left out of the result
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	servers, err := query.GetPorts(ctx, append(ports, malformedPort, silent.LocalAddr().(*net.UDPAddr).Port), false)
+	assert.NoError(t, err)
+	assert.Len(t, servers, 2)
+	assert.Equal(t, "first", servers[ports[0]].Hostname)
+	assert.Equal(t, "first", servers[ports[0]].Rules["hostname"])
+	assert.Equal(t, "second", servers[ports[1]].Hostname)
+	assert.Equal(t, "second", servers[ports[1]].Rules["hostname"])
+	assert.Equal(t, "127.0.0.1:"+strconv.Itoa(ports[1]), servers[ports[1]].Address)
+}
+
+func TestQuery_GetPorts_OtherHost(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer server.Close()
+	port := server.LocalAddr().(*net.UDPAddr).Port
+
+	// another host replies from the same port in the server's place
+	impostor, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	if err != nil {
+		t.Skip("can't listen on 127.0.0.2:", err)
+	}
+	defer impostor.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if QueryType(buf[10]) == Info {
+				impostor.WriteToUDP(buildResponse(buf[:n], buildInfoPayload(false, 1, 50, "impostor", "gamemode", "English")), from)
+			}
+		}
+	}()
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	servers, err := query.GetPorts(ctx, []int{port}, false)
+	assert.NoError(t, err)
+	assert.Empty(t, servers)
+}
@@ -0,0 +1,46 @@
+package sampquery
+
+import (
+	"context"
+	"sync"
+)
+
+// probeOpcodes are the queries ProbeOpcodes tries, RCON is left out as it needs a password.
+var probeOpcodes = []QueryType{Info, Rules, Players, DetailedPlayers, Ping, IsOmp}
+
+// ProbeOpcodes sends each kind of query to the server at host at once and reports which it answered,
+// for diagnosing servers behind firewalls that only let some opcodes through. Queries that go
+// unanswered wait until ctx is done, so give it a deadline. Only failing to resolve host is an error.
+func ProbeOpcodes(ctx context.Context, host string, opts ...Option) (answered map[QueryType]bool, err error) {
+	query, err := NewQueryContext(ctx, host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	answered = make(map[QueryType]bool, len(probeOpcodes))
+	for _, opcode := range probeOpcodes {
+		opcode := opcode
+		clone := query.Clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer clone.Close()
+
+			response, err := clone.SendQuery(ctx, opcode)
+			mu.Lock()
+			answered[opcode] = err == nil && response != nil
+			mu.Unlock()
+		}()
+		// a connection supplied with WithConn can't be read from concurrently
+		if query.userConn != nil {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+	return answered, nil
+}
@@ -0,0 +1,59 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeOpcodes(t *testing.T) {
+	// a firewall in front of the server only lets info and ping through
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Ping:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	answered, err := ProbeOpcodes(ctx, addr)
+	assert.NoError(t, err)
+	assert.Equal(t, map[QueryType]bool{
+		Info:            true,
+		Rules:           false,
+		Players:         false,
+		DetailedPlayers: false,
+		Ping:            true,
+		IsOmp:           false,
+	}, answered)
+}
+
+func TestProbeOpcodes_RandReader(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		if QueryType(request[10]) == Ping {
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the clones build their ping and omp packets at once from the one reader
+	answered, err := ProbeOpcodes(ctx, addr, WithRandReader(bytes.NewReader(make([]byte, 64))))
+	assert.NoError(t, err)
+	assert.True(t, answered[Ping])
+}
+
+func TestProbeOpcodes_BadHost(t *testing.T) {
+	_, err := ProbeOpcodes(context.Background(), "127.0.0.1")
+	assert.Error(t, err)
+}
@@ -3,15 +3,25 @@ package sampquery
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
-	"math/rand"
+	"fmt"
+	"io"
+	"math"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 )
 
 // Server contains all the information retreived from the server query API.
@@ -26,6 +36,110 @@ type Server struct {
 	Rules      map[string]string `json:"rules"`
 	Ping       int               `json:"ping"`
 	IsOmp      bool              `json:"isOmp"`
+
+	// OmpVersion is the version newer open.mp builds send in reply to the open.mp check. It's only
+	// populated when that check is needed, servers identified as open.mp from their rules skip it.
+	OmpVersion string `json:"omp_version,omitempty"`
+
+	// ResolvedAddress is the ip:port Address resolved to, useful for deduplicating servers listed
+	// under several hostnames.
+	ResolvedAddress string `json:"resolved_address"`
+
+	// Discord and Website are only sent by newer open.mp builds, in that order, after the language.
+	Discord string `json:"discord,omitempty"`
+	Website string `json:"website,omitempty"`
+
+	// QueriedAt is when the query that produced this result completed, for telling how stale it is.
+	QueriedAt time.Time `json:"queried_at"`
+
+	// Answered records which of the queries sent to build this result the server answered, queries
+	// that weren't sent are left out.
+	Answered map[QueryType]bool `json:"answered,omitempty"`
+
+	// RawHostname, RawGamemode and RawLanguage hold the fields' bytes exactly as the server sent them,
+	// before any decoding. Only populated with WithRawFields, for debugging encoding issues.
+	RawHostname []byte `json:"raw_hostname,omitempty"`
+	RawGamemode []byte `json:"raw_gamemode,omitempty"`
+	RawLanguage []byte `json:"raw_language,omitempty"`
+
+	// DetectedEncoding maps "hostname", "gamemode" and "language" to the name of the encoding they
+	// were decoded from. Only populated when decoding is attempted and a field needed decoding.
+	DetectedEncoding map[string]string `json:"detected_encoding,omitempty"`
+
+	// DetectionConfidence maps the same fields to how confident charset detection was in their
+	// encoding, from 1 to 100. Fields decoded using the server's language or left as-is are absent,
+	// low values are worth flagging for review as detection on short text is often a guess.
+	DetectionConfidence map[string]int `json:"detection_confidence,omitempty"`
+}
+
+// String returns a short single-line summary of the server, suitable for log lines.
+func (s Server) String() string {
+	return fmt.Sprintf("%s (%d/%d) [%s] ping=%dms omp=%t",
+		s.Hostname, s.Players, s.MaxPlayers, s.Gamemode, time.Duration(s.Ping).Milliseconds(), s.IsOmp)
+}
+
+// FillPercent returns how full the server is as a percentage of its player slots, or zero for a
+// server reporting no slots at all.
+func (s Server) FillPercent() float64 {
+	if s.MaxPlayers <= 0 {
+		return 0
+	}
+	return float64(s.Players) / float64(s.MaxPlayers) * 100
+}
+
+// LanguageCode returns the server's language as a short language code such as "ru" or "pt",
+// recognising both names and codes. It's empty for the unset placeholder and unrecognised languages.
+func (s Server) LanguageCode() string {
+	if i := lookupLanguage(s.Language); i >= 0 {
+		return languages[i].code
+	}
+	return ""
+}
+
+// ToMap returns the server as a generic map for templating and similar pipelines, keyed by the JSON
+// field names. Rules are flattened into it as "rules.<name>" rather than nested. The raw fields are
+// included as strings of their undecoded bytes.
+func (s Server) ToMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"address":          s.Address,
+		"hostname":         s.Hostname,
+		"players":          s.Players,
+		"max_players":      s.MaxPlayers,
+		"gamemode":         s.Gamemode,
+		"language":         s.Language,
+		"password":         s.Password,
+		"ping":             s.Ping,
+		"isOmp":            s.IsOmp,
+		"omp_version":      s.OmpVersion,
+		"resolved_address": s.ResolvedAddress,
+		"discord":          s.Discord,
+		"website":          s.Website,
+		"queried_at":       s.QueriedAt,
+		"raw_hostname":     string(s.RawHostname),
+		"raw_gamemode":     string(s.RawGamemode),
+		"raw_language":     string(s.RawLanguage),
+	}
+	for field, charset := range s.DetectedEncoding {
+		m["detected_encoding."+field] = charset
+	}
+	for field, confidence := range s.DetectionConfidence {
+		m["detection_confidence."+field] = confidence
+	}
+	for opcode, ok := range s.Answered {
+		m["answered."+opcode.String()] = ok
+	}
+	for name, value := range s.Rules {
+		m["rules."+name] = value
+	}
+	return m
+}
+
+// Player is an entry from the detailed player list.
+type Player struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+	Ping  int    `json:"ping"`
 }
 
 // QueryType represents a query method from the SA:MP set: i, r, c, d, x, p
@@ -40,52 +154,174 @@ const (
 	Players QueryType = 'c'
 	// Ping is the 'p' packet type
 	Ping QueryType = 'p'
+	// DetailedPlayers is the 'd' packet type
+	DetailedPlayers QueryType = 'd'
 	// IsOmp is the 'o' packet type
 	IsOmp QueryType = 'o'
+	// RCON is the 'x' packet type, used to run remote admin commands
+	RCON QueryType = 'x'
+	// Challenge is the 'h' packet type, sent by open.mp servers running anti-spoofing in place of
+	// the requested data. It carries a 4 byte token that must be echoed back with the request.
+	Challenge QueryType = 'h'
 )
 
+// String returns a readable name for the query type, or the raw opcode character if it is unknown.
+func (q QueryType) String() string {
+	switch q {
+	case Info:
+		return "info"
+	case Rules:
+		return "rules"
+	case Players:
+		return "players"
+	case Ping:
+		return "ping"
+	case DetailedPlayers:
+		return "detailed players"
+	case IsOmp:
+		return "omp"
+	case RCON:
+		return "rcon"
+	case Challenge:
+		return "challenge"
+	}
+	return string(rune(q))
+}
+
+// MarshalText encodes the query type as its String, so maps keyed by it encode readably as JSON.
+func (q QueryType) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// UnmarshalText decodes a query type encoded by MarshalText.
+func (q *QueryType) UnmarshalText(text []byte) error {
+	for _, opcode := range []QueryType{Info, Rules, Players, Ping, DetailedPlayers, IsOmp, RCON, Challenge} {
+		if opcode.String() == string(text) {
+			*q = opcode
+			return nil
+		}
+	}
+	if len(text) != 1 {
+		return errors.Errorf("unknown query type %q", text)
+	}
+	*q = QueryType(text[0])
+	return nil
+}
+
+// maxPacketSize is the largest payload a single UDP datagram can carry over IPv4. Servers with a
+// lot of rules (such as open.mp servers advertising DL artifacts) easily exceed a couple of KB.
+const maxPacketSize = 65507
+
+// ErrTooManyPlayers is returned by GetPlayers when the server has more players online than the
+// player list query can reliably return.
+var ErrTooManyPlayers = errors.New("too many players online to query the player list")
+
+// ErrShortResponse is returned when a response is too short to even hold the packet header, the
+// returned error wraps it along with the number of bytes that did arrive.
+var ErrShortResponse = errors.New("response is less than 11 bytes")
+
+// ErrResponseTooLarge is returned when a response exceeds the maximum size set by
+// WithMaxResponseSize.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// ErrTimeout is returned when ctx is done or every attempt runs out of time before the server
+// answers. When retries are enabled the returned error wraps it along with the number of attempts.
+var ErrTimeout = errors.New("socket read timed out")
+
+// ErrClosed is returned when using a Query after it has been closed.
+var ErrClosed = errors.New("query is closed")
+
+// ErrTokenMismatch is returned in place of a timeout when the only replies a ping or open.mp check
+// got didn't echo back the random token sent with the request, so they can't have come from the
+// server being queried in answer to it.
+var ErrTokenMismatch = errors.New("response token does not match request")
+
+// ErrConnRefused is returned when the server's host reported that nothing is listening on the port,
+// which the OS surfaces on the read following a send. It usually means the server is down.
+var ErrConnRefused = errors.New("connection refused")
+
+// ErrRulesTruncated is returned by GetRules, along with the rules it could parse, when the response
+// ends before all of the rules it declares. It's not fatal, the rules returned are just incomplete.
+var ErrRulesTruncated = errors.New("rules response truncated")
+
 // Query stores state for masterlist queries
 type Query struct {
 	addr *net.UDPAddr
+	options
 	Data Server
+
+	requestID string
+
+	connMu    sync.Mutex
+	conn      net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	readsMu   sync.Mutex
+	reads     int
+	readsDone chan struct{}
+
+	statsMu   sync.Mutex
+	bytesRead map[QueryType]int
+	answered  map[QueryType]bool
 }
 
 // GetServerInfo wraps a set of queries and returns a new Server object with the available fields
 // populated. `attemptDecode` determines whether or not to attempt to decode ANSI into Unicode from
-// servers that use different codepages such as Cyrillic. This function can panic if the socket it
-// opens fails to close for whatever reason.
-func GetServerInfo(ctx context.Context, host string, attemptDecode bool) (server Server, err error) {
-	query, err := NewQuery(host)
+// servers that use different codepages such as Cyrillic. A failure to close the socket it opens is
+// returned if the queries themselves succeeded. Any options are passed on to the underlying Query.
+// Errors are prefixed with the host so failures are identifiable when querying many servers.
+func GetServerInfo(ctx context.Context, host string, attemptDecode bool, opts ...Option) (server Server, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%s: %w", host, err)
+		}
+	}()
+
+	query, err := NewQueryContext(ctx, host, opts...)
 	if err != nil {
 		return
 	}
+	// the queries are all to the same server, so send them over one socket rather than dialling one
+	// for each, it's closed along with the query below
+	query.reusePort = true
 	defer func() {
-		if e := query.Close(); e != nil {
-			panic(e)
+		if e := query.Close(); e != nil && err == nil {
+			err = errors.Wrap(e, "failed to close socket")
 		}
 	}()
 
-	server, err = query.GetInfo(ctx, attemptDecode)
-	if err != nil {
-		return
+	return query.getServerInfo(ctx, host, attemptDecode)
+}
+
+// getServerInfo runs GetServerInfo's queries against query, host is only used to fill in the
+// server's address.
+func (query *Query) getServerInfo(ctx context.Context, host string, attemptDecode bool) (server Server, err error) {
+	defer func() {
+		server.Answered = query.Answered()
+	}()
+
+	var ping time.Duration
+	if query.parallel && query.userConn == nil {
+		server, ping, err = query.getParallel(ctx, attemptDecode)
+	} else {
+		server, ping, err = query.getSequential(ctx, attemptDecode)
 	}
 	server.Address = host
-
-	server.Rules, err = query.GetRules(ctx)
+	server.ResolvedAddress = query.addr.String()
 	if err != nil {
 		return
 	}
-
-	ping, err := query.GetPing(ctx)
-	if err != nil {
+	server.Ping = int(ping)
+	if query.skipPassworded && server.Password {
+		server.QueriedAt = query.now()
 		return
 	}
-	server.Ping = int(ping)
 
 	var isOmp bool
 	requiresAdditionalOmpCheck := false
 	ver, found := server.Rules["version"]
-	_, found2 := server.Rules["allow_DL"]
+	_, found2 := ParseDLRules(server.Rules)
 
 	if found {
 		requiresAdditionalOmpCheck = strings.Contains(ver, "omp ")
@@ -96,78 +332,401 @@ func GetServerInfo(ctx context.Context, host string, attemptDecode bool) (server
 	}
 
 	if !requiresAdditionalOmpCheck {
-		isOmp = query.GetOmpValidity(ctx)
+		isOmp, server.OmpVersion = query.GetOmpVersion(ctx)
 	} else {
 		isOmp = true
 	}
 
 	server.IsOmp = isOmp
+	server.QueriedAt = query.now()
 	return
 }
 
+// getSequential fetches the info, rules and ping for GetServerInfo one after the other.
+func (query *Query) getSequential(ctx context.Context, attemptDecode bool) (server Server, ping time.Duration, err error) {
+	server, err = query.GetInfo(ctx, attemptDecode)
+	if err != nil {
+		return
+	}
+	if query.skipPassworded && server.Password {
+		return
+	}
+
+	// a truncated rules response still leaves the rest of the server's info worth returning
+	server.Rules, err = query.GetRules(ctx)
+	if err != nil && err != ErrRulesTruncated {
+		return
+	}
+
+	ping, err = query.GetPing(ctx)
+	return
+}
+
+// GetServerInfoTimeout is GetServerInfo for callers without a context to hand, the queries are
+// given timeout to complete in.
+func GetServerInfoTimeout(host string, timeout time.Duration, attemptDecode bool, opts ...Option) (Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return GetServerInfo(ctx, host, attemptDecode, opts...)
+}
+
+// IsOnline reports whether the server at host answers a ping query before ctx is done. It never
+// returns an error, anything that stops the server answering simply means it's offline.
+func IsOnline(ctx context.Context, host string, opts ...Option) bool {
+	query, err := NewQueryContext(ctx, host, opts...)
+	if err != nil {
+		return false
+	}
+	defer query.Close()
+
+	_, err = query.SendQuery(ctx, Ping)
+	return err == nil
+}
+
 // NewQuery creates a new query handler for a server
-func NewQuery(host string) (query *Query, err error) {
-	query = new(Query)
+func NewQuery(host string, opts ...Option) (query *Query, err error) {
+	return NewQueryContext(context.Background(), host, opts...)
+}
+
+// NewQueryContext is NewQuery with ctx used for resolving host, so a cancelled or expired context
+// stops a slow DNS lookup instead of waiting on it.
+func NewQueryContext(ctx context.Context, host string, opts ...Option) (query *Query, err error) {
+	query = &Query{
+		options: options{
+			bufferSize:  maxPacketSize,
+			magic:       "SAMP",
+			playerLimit: 100,
+			ompTimeout:  time.Second,
+
+			retryBase:       500 * time.Millisecond,
+			retryMultiplier: 2,
+
+			languagePlaceholder: "-",
+		},
+		closed: make(chan struct{}),
+	}
+
+	// fail before any lookup if ctx is already done, returning its error as is for errors.Is
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	query.addr, err = net.ResolveUDPAddr("udp", host)
+	for _, opt := range opts {
+		opt(query)
+	}
+
+	if id, ok := RequestIDFromContext(ctx); ok {
+		query.requestID = id
+	} else {
+		query.requestID = newRequestID()
+	}
+	if query.logger != nil {
+		query.logger = query.logger.With("request_id", query.requestID)
+	}
+
+	query.addr, err = query.resolveQueryAddr(ctx, host)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to resolve host")
+		return nil, err
 	}
 
 	return query, nil
 }
 
-// Close closes a query manager's connection
-func (query *Query) Close() error {
-	return nil
+// resolveQueryAddr resolves host to an address that can be queried.
+func (query *Query) resolveQueryAddr(ctx context.Context, host string) (*net.UDPAddr, error) {
+	addr, err := query.resolveUDPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host: %w", err)
+	}
+
+	if len(addr.IP) == 0 {
+		return nil, errors.Errorf("host %s is missing an address to query", host)
+	}
+	// the packet header embeds the server's address as 4 bytes, so there's no way to query over IPv6
+	if addr.IP.To4() == nil {
+		return nil, errors.Errorf("host %s resolved to IPv6 address %s, only IPv4 is supported", host, addr.IP)
+	}
+	// none of these are a single server that could answer, and replies can't be matched up anyway
+	switch {
+	case addr.IP.IsMulticast():
+		return nil, errors.Errorf("host %s resolved to multicast address %s", host, addr.IP)
+	case addr.IP.Equal(net.IPv4bcast):
+		return nil, errors.Errorf("host %s resolved to broadcast address %s", host, addr.IP)
+	case addr.IP.IsUnspecified():
+		return nil, errors.Errorf("host %s resolved to unspecified address %s", host, addr.IP)
+	}
+	return addr, nil
 }
 
-// SendQuery writes a SA:MP format query with the specified opcode, returns the raw response bytes
-func (query *Query) SendQuery(ctx context.Context, opcode QueryType) (response []byte, err error) {
-	request := new(bytes.Buffer)
+// resolveUDPAddr does what net.ResolveUDPAddr does, preferring an IPv4 address when the host has
+// both, but with the lookups bound to ctx and made with the resolver set by WithResolver.
+func (query *Query) resolveUDPAddr(ctx context.Context, host string) (*net.UDPAddr, error) {
+	hostname, service, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
 
-	port := [2]byte{
-		byte(query.addr.Port & 0xFF),
-		byte((query.addr.Port >> 8) & 0xFF),
+	var resolver Resolver = net.DefaultResolver
+	if query.resolver != nil {
+		resolver = query.resolver
 	}
 
-	if err = binary.Write(request, binary.LittleEndian, []byte("SAMP")); err != nil {
-		return
+	port, err := resolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
 	}
-	if err = binary.Write(request, binary.LittleEndian, query.addr.IP.To4()); err != nil {
-		return
+
+	if hostname == "" {
+		return &net.UDPAddr{Port: port}, nil
 	}
-	if err = binary.Write(request, binary.LittleEndian, port[0]); err != nil {
-		return
+	if ip := net.ParseIP(hostname); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
 	}
-	if err = binary.Write(request, binary.LittleEndian, port[1]); err != nil {
-		return
+
+	var addrs []net.IPAddr
+	for attempt := 0; ; attempt++ {
+		addrs, err = resolver.LookupIPAddr(ctx, hostname)
+		if err == nil || attempt >= query.resolveRetries || !isTransientDNSError(err) {
+			break
+		}
+
+		wait := query.resolveBackoff << uint(attempt)
+		if query.logger != nil {
+			query.logger.Debug("failed to resolve host, retrying", "host", hostname, "attempt", attempt+1, "wait", wait, "error", err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
-	if err = binary.Write(request, binary.LittleEndian, opcode); err != nil {
-		return
+	if err != nil {
+		// a lookup cut short by ctx fails with the resolver's own error, report why it was cut short
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses found for %s", hostname)
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return &net.UDPAddr{IP: addr.IP, Port: port}, nil
+		}
+	}
+	return &net.UDPAddr{IP: addrs[0].IP, Zone: addrs[0].Zone, Port: port}, nil
+}
 
-	if opcode == Ping || opcode == IsOmp {
-		p := make([]byte, 4)
-		_, err = rand.Read(p)
-		if err != nil {
+// ValidateHost checks that host is a well formed host:port address with a port in range that
+// resolves to a queryable address. Useful for filtering bad entries out of a list before querying.
+func ValidateHost(host string) error {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return errors.Wrap(err, "invalid address")
+	}
+	if hostname == "" {
+		return errors.Errorf("address %s is missing a host", host)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return errors.Errorf("address %s has invalid port %s", host, port)
+	}
+
+	_, err = NewQuery(host)
+	return err
+}
+
+// NewQueryHostPort creates a new query handler for a server from a separate host and port, saving
+// callers from formatting the address themselves and getting IPv6 brackets wrong.
+func NewQueryHostPort(host string, port int, opts ...Option) (query *Query, err error) {
+	return NewQuery(net.JoinHostPort(host, strconv.Itoa(port)), opts...)
+}
+
+// Clone returns an independent copy of the query with the same address and options. A template
+// query can be cloned for each worker in a pool, the clones can then be used concurrently.
+func (query *Query) Clone() *Query {
+	return &Query{
+		addr: &net.UDPAddr{
+			IP:   append(net.IP(nil), query.addr.IP...),
+			Port: query.addr.Port,
+			Zone: query.addr.Zone,
+		},
+		options:   query.options,
+		requestID: query.requestID,
+		closed:    make(chan struct{}),
+	}
+}
+
+// Reset points the query at a different host so it can be reused, for example from a pool, without
+// allocating a new one. The options stay as they were, while everything learned about the previous
+// server is cleared. With WithSourcePortReuse the old connection is closed and a new one is dialled
+// to the new host by the next query. On error the query is left pointing at the previous host.
+func (query *Query) Reset(host string) error {
+	if query.isClosed() {
+		return ErrClosed
+	}
+
+	addr, err := query.resolveQueryAddr(context.Background(), host)
+	if err != nil {
+		return err
+	}
+
+	query.connMu.Lock()
+	defer query.connMu.Unlock()
+	if query.isClosed() {
+		return ErrClosed
+	}
+	if query.conn != nil {
+		// the old connection is useless to the new host, so a failure closing it doesn't matter
+		query.conn.Close()
+		query.conn = nil
+	}
+
+	query.addr = addr
+	query.Data = Server{}
+
+	query.statsMu.Lock()
+	query.bytesRead = nil
+	query.answered = nil
+	query.statsMu.Unlock()
+	return nil
+}
+
+// closeWait bounds how long Close waits for in-flight reads to give up before closing the connection
+// underneath them anyway.
+const closeWait = 100 * time.Millisecond
+
+// Close closes a query manager's connection, any queries made afterwards fail with ErrClosed. It's
+// safe to call more than once and from multiple goroutines, only the first call does anything and
+// returns the error from closing the connection, if any. Reads still in flight on a reused connection
+// are cancelled and Close waits briefly for them to return before closing it.
+func (query *Query) Close() (err error) {
+	query.closeOnce.Do(func() {
+		close(query.closed)
+
+		query.connMu.Lock()
+		conn := query.conn
+		query.connMu.Unlock()
+		if conn == nil {
 			return
 		}
-		if err = binary.Write(request, binary.LittleEndian, p); err != nil {
-			return
+
+		conn.SetReadDeadline(time.Now())
+		query.waitReads(closeWait)
+
+		// Reset may have closed the connection while the reads were waited on
+		query.connMu.Lock()
+		defer query.connMu.Unlock()
+		if query.conn != nil {
+			err = query.conn.Close()
+			query.conn = nil
 		}
+	})
+	return
+}
+
+// isClosed reports whether Close has been called. Callers storing a connection check it while
+// holding connMu, after which Close is guaranteed to see and close what they stored.
+func (query *Query) isClosed() bool {
+	select {
+	case <-query.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// beginRead marks a read as in flight, to be paired with endRead once it returns.
+func (query *Query) beginRead() {
+	query.readsMu.Lock()
+	defer query.readsMu.Unlock()
+	if query.reads == 0 {
+		query.readsDone = make(chan struct{})
+	}
+	query.reads++
+}
+
+func (query *Query) endRead() {
+	query.readsMu.Lock()
+	defer query.readsMu.Unlock()
+	query.reads--
+	if query.reads == 0 {
+		close(query.readsDone)
 	}
+}
 
-	conn, err := openConnection(query.addr)
+// waitReads waits up to timeout for every in-flight read to return.
+func (query *Query) waitReads(timeout time.Duration) {
+	query.readsMu.Lock()
+	if query.reads == 0 {
+		query.readsMu.Unlock()
+		return
+	}
+	done := query.readsDone
+	query.readsMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// SendQuery writes a SA:MP format query with the specified opcode, returns the raw response bytes
+func (query *Query) SendQuery(ctx context.Context, opcode QueryType) (response []byte, err error) {
+	if query.hooks.QueryStart != nil {
+		if hookCtx := query.hooks.QueryStart(ctx, opcode); hookCtx != nil {
+			ctx = hookCtx
+		}
+	}
+	if query.hooks.QueryEnd != nil {
+		start := query.now()
+		defer func() {
+			query.hooks.QueryEnd(ctx, opcode, query.now().Sub(start), err)
+		}()
+	}
+	defer func() {
+		query.recordAnswered(opcode, err == nil && response != nil)
+	}()
+
+	response, err = query.exchange(ctx, opcode, query.bufferSize)
+	// a response that filled the whole buffer was most likely cut short by the socket, which drops
+	// whatever didn't fit, so ask again with room for the largest possible response
+	if err == nil && response != nil && len(response) == cap(response) && cap(response) < maxPacketSize {
+		if query.logger != nil {
+			query.logger.Debug("response filled the read buffer, resending with a larger one", "addr", query.addr, "opcode", opcode.String(), "bytes", len(response))
+		}
+		response, err = query.exchange(ctx, opcode, maxPacketSize)
+	}
+	return
+}
+
+// exchange sends a query and reads its response into a buffer of bufferSize bytes.
+func (query *Query) exchange(ctx context.Context, opcode QueryType, bufferSize int) (response []byte, err error) {
+	request, err := query.BuildQueryPacket(opcode)
+	if err != nil {
+		return
+	}
+
+	conn, err := query.openConnection()
 	if err != nil {
 		return
 	}
 	defer conn.Close()
 
-	_, err = conn.Write(request.Bytes())
+	_, err = conn.Write(request)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to write")
 	}
+	if query.logger != nil {
+		query.logger.Debug("sent query", "addr", query.addr, "opcode", opcode.String(), "bytes", len(request))
+	}
 
 	type resultData struct {
 		data  []byte
@@ -176,22 +735,125 @@ func (query *Query) SendQuery(ctx context.Context, opcode QueryType) (response [
 	}
 	waitResult := make(chan resultData, 1)
 
-	go func() {
-		response := make([]byte, 2048)
+	_, shared := conn.(sharedConn)
+	tokened := opcode == Ping || opcode == IsOmp
+	// set when a reply was skipped for carrying a token this query never sent
+	var mismatched atomic.Bool
 
-		if opcode == IsOmp {
-			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	query.beginRead()
+	go func() {
+		defer query.endRead()
+		response := query.newReadBuffer(bufferSize)
+
+		var (
+			n        int
+			errInner error
+			attempt  int
+			// the tokens sent by earlier attempts, so late replies to them can be told apart
+			spent [][]byte
+		)
+		// a reused socket may still have a late reply to an earlier query queued up, and any socket
+		// may get a late reply to an earlier attempt at this one, both are skipped past. Only the
+		// reply echoing the latest attempt's token is accepted, anything else can't be its answer.
+		stale := func() bool {
+			if n < 11 {
+				return false
+			}
+			if shared && QueryType(response[10]) != opcode && QueryType(response[10]) != Challenge {
+				return true
+			}
+			if !tokened || QueryType(response[10]) != opcode {
+				return false
+			}
+			if n >= 15 && bytes.Equal(response[11:15], request[11:15]) {
+				return false
+			}
+			if n >= 15 {
+				for _, token := range spent {
+					if bytes.Equal(response[11:15], token) {
+						return true
+					}
+				}
+			}
+			mismatched.Store(true)
+			return true
 		}
+		for ; ; attempt++ {
+			if attempt > 0 {
+				if query.logger != nil {
+					query.logger.Debug("no response, retrying query", "addr", query.addr, "opcode", opcode.String(), "attempt", attempt+1)
+				}
+				// each attempt gets its own token, a reply is only accepted if it echoes the latest
+				if tokened {
+					spent = append(spent, request[11:15])
+					if request, errInner = query.BuildQueryPacket(opcode); errInner != nil {
+						waitResult <- resultData{err: errInner}
+						return
+					}
+				}
+				if _, errInner = conn.Write(request); errInner != nil {
+					waitResult <- resultData{err: errors.Wrap(errInner, "failed to write")}
+					return
+				}
+			}
+
+			if opcode == IsOmp {
+				conn.SetReadDeadline(time.Now().Add(query.ompTimeout))
+			} else if timeout := query.attemptTimeout(attempt); timeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(timeout))
+			} else if shared {
+				conn.SetReadDeadline(time.Time{})
+			}
+
+			n, errInner = conn.Read(response)
+			for errInner == nil && stale() {
+				n, errInner = conn.Read(response)
+			}
 
-		n, errInner := conn.Read(response)
+			// the omp check is never retried, plain SA:MP servers don't answer it at all, and a read
+			// cut short by Close isn't a timeout worth retrying
+			if opcode == IsOmp || attempt >= query.retries || ctx.Err() != nil || query.isClosed() || !isTimeout(errInner) {
+				break
+			}
+		}
 		if errInner != nil {
-			waitResult <- resultData{err: errors.Wrap(errInner, "failed to read response")}
+			if query.isClosed() {
+				waitResult <- resultData{err: ErrClosed}
+				return
+			}
+			if isTimeout(errInner) && mismatched.Load() {
+				waitResult <- resultData{err: ErrTokenMismatch}
+				return
+			}
+			if query.retries > 0 && opcode != IsOmp && isTimeout(errInner) {
+				waitResult <- resultData{err: fmt.Errorf("%w after %d attempts", ErrTimeout, attempt+1)}
+				return
+			}
+			waitResult <- resultData{err: readError(errInner)}
 			return
 		}
-		if n > cap(response) {
-			waitResult <- resultData{err: errors.New("read response over buffer capacity")}
-			return
+
+		// the server wants proof that we own our source address before it answers, so resend the
+		// original request with its token appended and read again
+		if n >= 15 && QueryType(response[10]) == Challenge && opcode != Challenge {
+			if query.logger != nil {
+				query.logger.Debug("received challenge, resending query with token", "addr", query.addr, "opcode", opcode.String())
+			}
+			_, errInner = conn.Write(append(request, response[11:15]...))
+			if errInner != nil {
+				waitResult <- resultData{err: errors.Wrap(errInner, "failed to write challenge response")}
+				return
+			}
+			n, errInner = conn.Read(response)
+			for errInner == nil && stale() {
+				n, errInner = conn.Read(response)
+			}
+			if errInner != nil {
+				waitResult <- resultData{err: readError(errInner)}
+				return
+			}
 		}
+
 		waitResult <- resultData{data: response, bytes: n}
 	}()
 
@@ -199,10 +861,19 @@ func (query *Query) SendQuery(ctx context.Context, opcode QueryType) (response [
 	select {
 	case <-ctx.Done():
 		{
+			// the socket outlives this query, so stop the read now rather than let it swallow the
+			// response to whatever query comes next
+			if shared {
+				conn.SetReadDeadline(time.Now())
+				<-waitResult
+			}
 			if opcode == IsOmp {
 				return nil, nil
 			}
-			return nil, errors.New("socket read timed out")
+			if mismatched.Load() {
+				return nil, ErrTokenMismatch
+			}
+			return nil, ErrTimeout
 		}
 
 	case result = <-waitResult:
@@ -212,46 +883,312 @@ func (query *Query) SendQuery(ctx context.Context, opcode QueryType) (response [
 	if result.err != nil {
 		return nil, result.err
 	}
+	query.recordBytesRead(opcode, result.bytes)
+	if err = query.checkResponseSize(result.bytes); err != nil {
+		return nil, err
+	}
 
-	if result.bytes < 11 {
-		return nil, errors.New("response is less than 11 bytes")
+	if query.logger != nil {
+		query.logger.Debug("received response", "addr", query.addr, "opcode", opcode.String(), "bytes", result.bytes)
 	}
 
+	if result.bytes < 11 {
+		return nil, fmt.Errorf("%w: got %d", ErrShortResponse, result.bytes)
+	}
+	if !query.hasMagic(result.data) {
+		return nil, errors.Errorf("response has magic %q, expected %q", result.data[:4], query.magic)
+	}
+	if port := echoedPort(result.data); port != query.addr.Port {
+		return nil, errors.Errorf("response is for port %d, expected %d", port, query.addr.Port)
+	}
 	return result.data[:result.bytes], nil
 }
 
+// BytesRead returns the raw size of the last response read for opcode, before any checks or
+// parsing, or zero if there hasn't been one. When chasing down truncated responses this can be
+// compared against the size the server should have sent: a read exactly as big as the read buffer
+// means the socket cut the response short.
+func (query *Query) BytesRead(opcode QueryType) int {
+	query.statsMu.Lock()
+	defer query.statsMu.Unlock()
+	return query.bytesRead[opcode]
+}
+
+func (query *Query) recordBytesRead(opcode QueryType, n int) {
+	query.statsMu.Lock()
+	defer query.statsMu.Unlock()
+	if query.bytesRead == nil {
+		query.bytesRead = make(map[QueryType]int)
+	}
+	query.bytesRead[opcode] = n
+}
+
+// Answered returns whether the server answered the most recent query with each opcode sent so far,
+// opcodes that haven't been sent are left out.
+func (query *Query) Answered() map[QueryType]bool {
+	query.statsMu.Lock()
+	defer query.statsMu.Unlock()
+	answered := make(map[QueryType]bool, len(query.answered))
+	for opcode, ok := range query.answered {
+		answered[opcode] = ok
+	}
+	return answered
+}
+
+func (query *Query) recordAnswered(opcode QueryType, ok bool) {
+	query.statsMu.Lock()
+	defer query.statsMu.Unlock()
+	if query.answered == nil {
+		query.answered = make(map[QueryType]bool)
+	}
+	query.answered[opcode] = ok
+}
+
+// hasMagic reports whether a response starts with the magic bytes requests are sent with.
+func (query *Query) hasMagic(response []byte) bool {
+	return len(response) >= 4 && string(response[:4]) == query.magic
+}
+
+// echoedPort returns the port a response says it's for, servers echo it from the request header.
+func echoedPort(response []byte) int {
+	return int(binary.LittleEndian.Uint16(response[8:10]))
+}
+
+// newReadBuffer allocates a buffer of size bytes to read a response into. When a smaller maximum
+// response size is set the buffer is just one byte larger, enough to tell that a response went over
+// without holding it all.
+func (query *Query) newReadBuffer(size int) []byte {
+	if query.maxResponseSize > 0 && query.maxResponseSize < size {
+		return make([]byte, query.maxResponseSize+1)
+	}
+	return make([]byte, size)
+}
+
+func (query *Query) checkResponseSize(n int) error {
+	if query.maxResponseSize > 0 && n > query.maxResponseSize {
+		return fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, query.maxResponseSize)
+	}
+	return nil
+}
+
+// BuildQueryPacket returns the exact packet SendQuery would write for an opcode without doing any
+// network I/O: the magic, the server address and port, the opcode and, for ping and omp checks,
+// 4 random bytes the server echoes back. Useful for protocol debugging and building fuzz corpora.
+func (query *Query) BuildQueryPacket(opcode QueryType) (packet []byte, err error) {
+	request := new(bytes.Buffer)
+
+	port := [2]byte{
+		byte(query.addr.Port & 0xFF),
+		byte((query.addr.Port >> 8) & 0xFF),
+	}
+
+	if err = binary.Write(request, binary.LittleEndian, []byte(query.magic)); err != nil {
+		return
+	}
+	if err = binary.Write(request, binary.LittleEndian, query.addr.IP.To4()); err != nil {
+		return
+	}
+	if err = binary.Write(request, binary.LittleEndian, port[0]); err != nil {
+		return
+	}
+	if err = binary.Write(request, binary.LittleEndian, port[1]); err != nil {
+		return
+	}
+	if err = binary.Write(request, binary.LittleEndian, opcode); err != nil {
+		return
+	}
+
+	if opcode == Ping || opcode == IsOmp {
+		p := make([]byte, 4)
+		if query.random != nil {
+			err = query.random.ReadFull(p)
+		} else {
+			_, err = rand.Read(p)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate random bytes")
+		}
+		if err = binary.Write(request, binary.LittleEndian, p); err != nil {
+			return
+		}
+	}
+
+	return request.Bytes(), nil
+}
+
 // GetPing sends and receives a packet to measure ping
 func (query *Query) GetPing(ctx context.Context) (ping time.Duration, err error) {
-	t := time.Now()
+	t := query.now()
 	_, err = query.SendQuery(ctx, Ping)
 	if err != nil {
 		return 0, err
 	}
-	ping = time.Now().Sub(t)
+	ping = query.now().Sub(t)
+
+	return
+}
+
+// GetPingMillis is GetPing with the round trip in whole milliseconds.
+func (query *Query) GetPingMillis(ctx context.Context) (int, error) {
+	ping, err := query.GetPing(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(ping.Milliseconds()), nil
+}
+
+// GetPingStats sends samples ping packets one after another and returns the fastest, slowest and
+// average round trip along with the jitter, which is the mean difference between consecutive round
+// trips. ctx applies to the whole set of samples, not each one individually.
+func (query *Query) GetPingStats(ctx context.Context, samples int) (min, max, avg, jitter time.Duration, err error) {
+	if samples < 1 {
+		return 0, 0, 0, 0, errors.New("at least one sample is required")
+	}
+
+	var total, variation, previous time.Duration
+	for i := 0; i < samples; i++ {
+		ping, err := query.GetPing(ctx)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if i == 0 || ping < min {
+			min = ping
+		}
+		if ping > max {
+			max = ping
+		}
+		if i > 0 {
+			diff := ping - previous
+			if diff < 0 {
+				diff = -diff
+			}
+			variation += diff
+		}
+		total += ping
+		previous = ping
+	}
 
+	avg = total / time.Duration(samples)
+	if samples > 1 {
+		jitter = variation / time.Duration(samples-1)
+	}
 	return
 }
 
 // GetOmpValidity sends and receives a packet to check if server is using open.mp or not
 func (query *Query) GetOmpValidity(ctx context.Context) bool {
-	var res, _ = query.SendQuery(ctx, IsOmp)
-	if res == nil {
-		return false
+	isOmp, _ := query.GetOmpVersion(ctx)
+	return isOmp
+}
+
+// GetOmpVersion is GetOmpValidity which also returns the version string newer open.mp builds append
+// to the reply, after the echoed bytes and prefixed with its length as 4 bytes. The version is empty
+// when the server only echoes.
+func (query *Query) GetOmpVersion(ctx context.Context) (isOmp bool, version string) {
+	isOmp, info := query.GetOmpInfo(ctx)
+	return isOmp, info.Version
+}
+
+// OmpInfo is the structured payload some open.mp builds send in reply to the open.mp check.
+type OmpInfo struct {
+	Version string `json:"version,omitempty"`
+
+	// Players and MaxPlayers follow the version as 2 bytes each on builds that send them, which can
+	// be used to corroborate the info query. HasCounts reports whether they were sent.
+	Players    int  `json:"players"`
+	MaxPlayers int  `json:"max_players"`
+	HasCounts  bool `json:"has_counts"`
+}
+
+// GetOmpInfo is GetOmpValidity which also returns whatever the server sent after the echoed bytes.
+// Servers that only echo are still open.mp, with an empty OmpInfo.
+func (query *Query) GetOmpInfo(ctx context.Context) (isOmp bool, info OmpInfo) {
+	response, _ := query.SendQuery(ctx, IsOmp)
+	if response == nil {
+		return false, info
 	}
+	return true, query.parseOmpInfo(response)
+}
 
-	return true
+// parseOmpInfo reads the optional version and player counts following the echoed bytes of an open.mp
+// check reply, keeping whatever could be read before anything truncated.
+func (query *Query) parseOmpInfo(response []byte) (info OmpInfo) {
+	ptr := 15
+	if len(response) < ptr+4 {
+		return
+	}
+	length := int(binary.LittleEndian.Uint32(response[ptr : ptr+4]))
+	ptr += 4
+	if length > len(response)-ptr {
+		if query.logger != nil {
+			query.logger.Warn("omp version truncated", "addr", query.addr, "declared", length, "remaining", len(response)-ptr)
+		}
+		return
+	}
+	info.Version = string(response[ptr : ptr+length])
+	ptr += length
+
+	if len(response)-ptr < 4 {
+		return
+	}
+	info.Players = int(binary.LittleEndian.Uint16(response[ptr : ptr+2]))
+	info.MaxPlayers = int(binary.LittleEndian.Uint16(response[ptr+2 : ptr+4]))
+	info.HasCounts = true
+	return
 }
 
 // GetInfo returns the core server info for displaying on the browser list.
+// The result is also stored in the query's Data field.
 func (query *Query) GetInfo(ctx context.Context, attemptDecode bool) (server Server, err error) {
 	response, err := query.SendQuery(ctx, Info)
 	if err != nil {
 		return server, err
 	}
 
+	server, err = query.parseInfo(response, attemptDecode)
+	if err != nil {
+		return server, err
+	}
+
+	query.Data = server
+	return server, nil
+}
+
+// GetInfoBefore is GetInfo for callers who think in absolute deadlines rather than contexts, the
+// query fails if it hasn't completed by deadline.
+func (query *Query) GetInfoBefore(deadline time.Time, attemptDecode bool) (Server, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	return query.GetInfo(ctx, attemptDecode)
+}
+
+// GetRulesBefore is GetRules with an absolute deadline in place of a context.
+func (query *Query) GetRulesBefore(deadline time.Time) (map[string]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	return query.GetRules(ctx)
+}
+
+// GetPlayersBefore is GetPlayers with an absolute deadline in place of a context.
+func (query *Query) GetPlayersBefore(deadline time.Time) ([]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	return query.GetPlayers(ctx)
+}
+
+func (query *Query) parseInfo(response []byte, attemptDecode bool) (server Server, err error) {
 	ptr := 11
 
-	server.Password = (response[ptr] == 1)
+	if len(response) < ptr+5 {
+		return server, errors.New("info response truncated before the player counts")
+	}
+
+	// any non-zero value means the server is locked, some buggy servers send values other than 1
+	server.Password = (response[ptr] != 0)
 	ptr++
 
 	server.Players = int(binary.LittleEndian.Uint16(response[ptr : ptr+2]))
@@ -260,61 +1197,119 @@ func (query *Query) GetInfo(ctx context.Context, attemptDecode bool) (server Ser
 	server.MaxPlayers = int(binary.LittleEndian.Uint16(response[ptr : ptr+2]))
 	ptr += 2
 
-	hostnameLen := int(binary.LittleEndian.Uint16(response[ptr : ptr+4]))
-	ptr += 4
+	// every length is checked against what's left before slicing, a corrupt one would otherwise
+	// push ptr past the end of the response and panic on the next read
+	readString := func(field string) (raw []byte, err error) {
+		if len(response)-ptr < 4 {
+			return nil, errors.Errorf("info response truncated before the %s length", field)
+		}
+		length := int(binary.LittleEndian.Uint16(response[ptr : ptr+4]))
+		ptr += 4
 
-	hostnameRaw := response[ptr : ptr+hostnameLen]
-	ptr += hostnameLen
+		if length > len(response)-ptr {
+			return nil, errors.Errorf("info response %s length %d exceeds the %d bytes remaining", field, length, len(response)-ptr)
+		}
+		raw = response[ptr : ptr+length]
+		ptr += length
+		return raw, nil
+	}
 
-	gamemodeLen := int(binary.LittleEndian.Uint16(response[ptr : ptr+4]))
-	ptr += 4
+	hostnameRaw, err := readString("hostname")
+	if err != nil {
+		return
+	}
 
-	gamemodeRaw := response[ptr : ptr+gamemodeLen]
-	ptr += gamemodeLen
+	gamemodeRaw, err := readString("gamemode")
+	if err != nil {
+		return
+	}
 
-	languageLen := int(binary.LittleEndian.Uint16(response[ptr : ptr+4]))
-	ptr += 4
+	languageRaw, err := readString("language")
+	if err != nil {
+		return
+	}
+	languageLen := len(languageRaw)
+
+	// newer open.mp builds append extra length-prefixed fields, older servers simply stop here
+	extra := readExtendedInfo(response[ptr:])
+	if len(extra) > 0 {
+		server.Discord = extra[0]
+	}
+	if len(extra) > 1 {
+		server.Website = extra[1]
+	}
 
-	languageRaw := response[ptr : ptr+languageLen]
+	if query.rawFields {
+		server.RawHostname = append([]byte{}, hostnameRaw...)
+		server.RawGamemode = append([]byte{}, gamemodeRaw...)
+		server.RawLanguage = append([]byte{}, languageRaw...)
+	}
 
-	guessHelper := bytes.Join([][]byte{
-		hostnameRaw,
-		gamemodeRaw,
-		languageRaw,
-	}, []byte(" "))
+	guessHelper := buildGuessHelper(hostnameRaw, gamemodeRaw, languageRaw)
 
 	if attemptDecode {
 		languageStr := ""
 		if languageLen > 0 {
 			languageStr = string(languageRaw)
 		}
-		server.Gamemode = attemptDecodeANSI(gamemodeRaw, guessHelper, languageStr)
-		server.Hostname = attemptDecodeANSI(hostnameRaw, guessHelper, languageStr)
+		server.DetectedEncoding = make(map[string]string)
+		server.Gamemode = query.decodeField(&server, "gamemode", gamemodeRaw, guessHelper, languageStr)
+		server.Hostname = query.decodeField(&server, "hostname", hostnameRaw, guessHelper, languageStr)
 	} else {
 		server.Gamemode = string(gamemodeRaw)
 		server.Hostname = string(hostnameRaw)
 	}
 
+	if query.stripColors {
+		server.Hostname = stripColors(server.Hostname)
+		server.Gamemode = stripColors(server.Gamemode)
+	}
+	if query.trimWhitespace {
+		server.Hostname = collapseWhitespace(server.Hostname)
+		server.Gamemode = collapseWhitespace(server.Gamemode)
+	}
+
 	if languageLen > 0 && attemptDecode {
-		server.Language = attemptDecodeANSI(languageRaw, guessHelper, string(languageRaw))
+		server.Language = query.decodeField(&server, "language", languageRaw, guessHelper, string(languageRaw))
 	} else {
-		server.Language = "-"
+		server.Language = query.languagePlaceholder
+	}
+
+	if query.logger != nil {
+		query.logger.Debug("parsed info", "addr", query.addr, "hostname", server.Hostname, "players", server.Players, "max_players", server.MaxPlayers)
 	}
 	return
 }
 
+// colorEmbed matches the {RRGGBB} colour codes SA:MP renders text after in the given colour.
+var colorEmbed = regexp.MustCompile(`\{[0-9A-Fa-f]{6}\}`)
+
+// stripColors removes every colour code from s.
+func stripColors(s string) string {
+	return colorEmbed.ReplaceAllString(s, "")
+}
+
+// collapseWhitespace trims s and replaces every run of whitespace inside it with a single space.
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
 // GetRules returns a map of rule properties from a server. The query uses established keys
 // such as "Map" and "Version"
 func (query *Query) GetRules(ctx context.Context) (rules map[string]string, err error) {
 	response, err := query.SendQuery(ctx, Rules)
-	responseLen := len(response)
 	if err != nil {
 		return rules, err
 	}
 
+	return query.parseRules(response)
+}
+
+func (query *Query) parseRules(response []byte) (rules map[string]string, err error) {
+	responseLen := len(response)
 	rules = make(map[string]string)
 
-	if responseLen < 20 {
+	if responseLen < 13 {
 		return rules, nil
 	}
 
@@ -325,15 +1320,22 @@ func (query *Query) GetRules(ctx context.Context) (rules map[string]string, err
 		valLen int
 	)
 
-	// fmt.Println("starting GetRules for", query.addr)
 	ptr := 11
 	amount := binary.LittleEndian.Uint16(response[ptr : ptr+2])
 	ptr += 2
 
+	valueLenSize := ruleValueLenSize(response, int(amount))
+
+	capped := false
+	parsed := 0
 	for i := uint16(0); i < amount && ptr < responseLen; i++ {
 		if ptr >= responseLen {
 			break
 		}
+		if query.maxRules > 0 && len(rules) >= query.maxRules {
+			capped = true
+			break
+		}
 
 		keyLen = int(response[ptr])
 		ptr++
@@ -345,12 +1347,15 @@ func (query *Query) GetRules(ctx context.Context) (rules map[string]string, err
 		key = string(response[ptr : ptr+keyLen])
 		ptr += keyLen
 
-		if ptr >= responseLen {
+		if ptr+valueLenSize > responseLen {
 			break
 		}
-
-		valLen = int(response[ptr])
-		ptr++
+		if valueLenSize == 2 {
+			valLen = int(binary.LittleEndian.Uint16(response[ptr : ptr+2]))
+		} else {
+			valLen = int(response[ptr])
+		}
+		ptr += valueLenSize
 
 		if ptr+valLen > responseLen {
 			break
@@ -360,128 +1365,683 @@ func (query *Query) GetRules(ctx context.Context) (rules map[string]string, err
 		ptr += valLen
 
 		rules[key] = val
+		parsed++
 	}
 
+	if query.logger != nil {
+		query.logger.Debug("parsed rules", "addr", query.addr, "declared", amount, "parsed", len(rules))
+		// fewer rules than declared almost always means the response was truncated
+		if capped {
+			query.logger.Warn("rules capped", "addr", query.addr, "declared", amount, "max", query.maxRules)
+		} else if parsed < int(amount) {
+			query.logger.Warn("rules response ended early", "addr", query.addr, "declared", amount, "parsed", parsed)
+		}
+	}
+	if !capped && parsed < int(amount) {
+		return rules, ErrRulesTruncated
+	}
 	return
 }
 
+// ruleValueLenSize works out whether a rules response prefixes values with their length as 1 byte,
+// as SA:MP does, or as 2 bytes, as some open.mp builds do. The version rule that would say which
+// is in the response itself, so instead the rules are walked with each size and whichever accounts
+// for exactly the declared number of rules and every byte of the response wins. Failing that, as
+// when a server pads the response with junk, 2 bytes wins only if the rules fit with it and not with
+// 1, where a rule name that isn't text means they don't fit. Anything else, like a truncated
+// response, is assumed to be the standard 1 byte.
+func ruleValueLenSize(response []byte, amount int) int {
+	// walk reports whether the declared rules fit in the response, and whether they end exactly at
+	// its end
+	walk := func(valueLenSize int) (fits, exact bool) {
+		ptr := 13
+		for i := 0; i < amount; i++ {
+			if ptr >= len(response) {
+				return false, false
+			}
+			keyEnd := ptr + 1 + int(response[ptr])
+			// rule names are plain text, walking with the wrong size soon lands on one that isn't
+			if keyEnd+valueLenSize > len(response) || !isText(response[ptr+1:keyEnd]) {
+				return false, false
+			}
+			ptr = keyEnd
+			if valueLenSize == 2 {
+				ptr += 2 + int(binary.LittleEndian.Uint16(response[ptr:ptr+2]))
+			} else {
+				ptr += 1 + int(response[ptr])
+			}
+		}
+		return ptr <= len(response), ptr == len(response)
+	}
+
+	fits1, exact1 := walk(1)
+	fits2, exact2 := walk(2)
+	if !exact1 && (exact2 || (!fits1 && fits2)) {
+		return 2
+	}
+	return 1
+}
+
 // GetPlayers simply returns a slice of strings, score is rather arbitrary so it's omitted.
+//
+// SA:MP servers stop answering the player list query, or answer with garbage, once more than about
+// 100 players are online. So if an earlier GetInfo reported more players than the query's player
+// limit, GetPlayers returns ErrTooManyPlayers without sending anything. See WithPlayerLimit.
 func (query *Query) GetPlayers(ctx context.Context) (players []string, err error) {
+	if query.playerLimit > 0 && query.Data.Players > query.playerLimit {
+		return nil, ErrTooManyPlayers
+	}
+
+	response, err := query.SendQuery(ctx, Players)
+	if err != nil {
+		return
+	}
+
+	return query.parsePlayers(response)
+}
+
+func (query *Query) parsePlayers(response []byte) (players []string, err error) {
+	players, _, err = query.parsePlayerList(response)
+	return
+}
+
+// StreamPlayers calls fn with the name and score of each player as the list is parsed, rather than
+// building the whole list first. Returning an error from fn stops the stream and is returned as is,
+// as is the context's error if ctx is done part way through. Players already passed to fn before
+// an error stay delivered, so callers can keep partial results.
+func (query *Query) StreamPlayers(ctx context.Context, fn func(name string, score int) error) (err error) {
+	if query.playerLimit > 0 && query.Data.Players > query.playerLimit {
+		return ErrTooManyPlayers
+	}
+
+	response, err := query.SendQuery(ctx, Players)
+	if err != nil {
+		return
+	}
+
+	return query.walkPlayerList(response, func(name string, score int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(name, score)
+	})
+}
+
+// GetPlayerScores returns the score of each online player keyed by name. Player names should be
+// unique but nothing stops a misbehaving server sending duplicates, in which case the highest score
+// is kept.
+func (query *Query) GetPlayerScores(ctx context.Context) (scores map[string]int, err error) {
+	if query.playerLimit > 0 && query.Data.Players > query.playerLimit {
+		return nil, ErrTooManyPlayers
+	}
+
 	response, err := query.SendQuery(ctx, Players)
 	if err != nil {
 		return
 	}
 
+	names, values, err := query.parsePlayerList(response)
+	if err != nil {
+		return
+	}
+
+	scores = make(map[string]int, len(names))
+	for i, name := range names {
+		if score, ok := scores[name]; !ok || values[i] > score {
+			scores[name] = values[i]
+		}
+	}
+	return scores, nil
+}
+
+// parsePlayerList parses the names and scores from a player list response, scores are all zero
+// when the server doesn't send them.
+func (query *Query) parsePlayerList(response []byte) (players []string, scores []int, err error) {
+	err = query.walkPlayerList(response, func(name string, score int) error {
+		players = append(players, name)
+		scores = append(scores, score)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if query.logger != nil {
+		query.logger.Debug("parsed players", "addr", query.addr, "players", len(players))
+	}
+	return players, scores, nil
+}
+
+// walkPlayerList calls fn with each player in a player list response as it's parsed, stopping at
+// the first error fn returns.
+func (query *Query) walkPlayerList(response []byte, fn func(name string, score int) error) (err error) {
 	var (
 		count  uint16
 		length int
 	)
 
+	if len(response) < 13 {
+		return errors.New("player response is missing the player count")
+	}
+
 	ptr := 11
 	count = binary.LittleEndian.Uint16(response[ptr : ptr+2])
 	ptr += 2
 
-	players = make([]string, count)
+	scoreSize := 4
+	if query.noPlayerScores {
+		scoreSize = 0
+	}
 
 	for i := uint16(0); i < count; i++ {
+		if ptr >= len(response) {
+			return errors.Errorf("player response truncated at player %d", i)
+		}
 		length = int(response[ptr])
 		ptr++
 
-		players[i] = string(response[ptr : ptr+length])
+		// the name and the score after it must both fit, otherwise the next read runs off the end
+		if ptr+length+scoreSize > len(response) {
+			return errors.Errorf("player response truncated at player %d", i)
+		}
+		name := string(response[ptr : ptr+length])
+		ptr += length
+
+		score := 0
+		if scoreSize > 0 {
+			score = int(int32(binary.LittleEndian.Uint32(response[ptr : ptr+4])))
+		}
+		ptr += scoreSize
+
+		if err = fn(name, score); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// GetDetailedPlayers returns the player list along with each player's ID, score and ping. It's
+// subject to the same player limit as GetPlayers.
+func (query *Query) GetDetailedPlayers(ctx context.Context) (players []Player, err error) {
+	if query.playerLimit > 0 && query.Data.Players > query.playerLimit {
+		return nil, ErrTooManyPlayers
+	}
+
+	response, err := query.SendQuery(ctx, DetailedPlayers)
+	if err != nil {
+		return
+	}
+
+	return query.parseDetailedPlayers(response)
+}
+
+// parseDetailedPlayers reads the 'd' response: a player count followed by, for each player, a one
+// byte ID, a length-prefixed name, a signed 32 bit score and a 32 bit ping.
+func (query *Query) parseDetailedPlayers(response []byte) (players []Player, err error) {
+	if len(response) < 13 {
+		return nil, errors.New("detailed player response is missing the player count")
+	}
+
+	ptr := 11
+	count := binary.LittleEndian.Uint16(response[ptr : ptr+2])
+	ptr += 2
+
+	players = make([]Player, 0, count)
+	for i := uint16(0); i < count; i++ {
+		if ptr+2 > len(response) {
+			return players, errors.Errorf("detailed player response truncated at player %d", i)
+		}
+		id := int(response[ptr])
+		length := int(response[ptr+1])
+		ptr += 2
+
+		if ptr+length+8 > len(response) {
+			return players, errors.Errorf("detailed player response truncated at player %d", i)
+		}
+		name := string(response[ptr : ptr+length])
 		ptr += length
-		ptr += 4 // score, unused
+
+		score := int(int32(binary.LittleEndian.Uint32(response[ptr : ptr+4])))
+		ptr += 4
+		ping := int(binary.LittleEndian.Uint32(response[ptr : ptr+4]))
+		ptr += 4
+
+		players = append(players, Player{ID: id, Name: name, Score: score, Ping: ping})
 	}
 
+	if query.logger != nil {
+		query.logger.Debug("parsed detailed players", "addr", query.addr, "players", len(players))
+	}
 	return players, nil
 }
 
-func openConnection(addr *net.UDPAddr) (conn *net.UDPConn, err error) {
-	conn, err = net.DialUDP("udp", nil, addr)
+// openConnection returns the connection to send a query over, which the caller must close. When the
+// caller supplied a connection or the source port is reused this is a long-lived connection which
+// isn't truly closed, otherwise it's a fresh connection.
+func (query *Query) openConnection() (conn net.Conn, err error) {
+	if query.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if query.userConn != nil {
+		return sharedConn{query.transformConn(query.userConn)}, nil
+	}
+
+	if query.reusePort {
+		query.connMu.Lock()
+		defer query.connMu.Unlock()
+		// Close may have run since the check above, a connection stored now would never be closed
+		if query.isClosed() {
+			return nil, ErrClosed
+		}
+		if query.conn != nil {
+			return sharedConn{query.conn}, nil
+		}
+	}
+
+	if query.dial != nil {
+		conn, err = query.dial(query.addr)
+	} else {
+		conn, err = net.DialUDP("udp", nil, query.addr)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to dial")
 	}
+	conn = query.transformConn(conn)
+
+	if query.reusePort {
+		query.conn = conn
+		return sharedConn{conn}, nil
+	}
+	return
+}
+
+// now returns the current time from the clock set with WithClock, or the real time.
+func (query *Query) now() time.Time {
+	if query.clock != nil {
+		return query.clock.Now()
+	}
+	return time.Now()
+}
+
+// attemptTimeout returns how long to wait for a response to the given attempt at a query, the first
+// being attempt zero, or zero to wait until the context is done. Each retry waits longer than the
+// last, so slow links get a chance to answer without every attempt waiting as long as the slowest.
+func (query *Query) attemptTimeout(attempt int) time.Duration {
+	if query.retries <= 0 {
+		return 0
+	}
+	return time.Duration(float64(query.retryBase) * math.Pow(query.retryMultiplier, float64(attempt)))
+}
+
+// isTransientDNSError reports whether a failed lookup might succeed if tried again, which is anything
+// except the name not existing.
+func isTransientDNSError(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return !ok || !dnsErr.IsNotFound
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// readError wraps an error from reading a response, mapping connection refusals to ErrConnRefused.
+func readError(err error) error {
+	if isConnRefused(err) {
+		return fmt.Errorf("%w: %v", ErrConnRefused, err)
+	}
+	return fmt.Errorf("failed to read response: %w", err)
+}
+
+// transformConn wraps conn so every packet passes through the transforms set with WithTransform.
+func (query *Query) transformConn(conn net.Conn) net.Conn {
+	if query.transformSend == nil && query.transformReceive == nil {
+		return conn
+	}
+	return transformedConn{conn, query.transformSend, query.transformReceive}
+}
+
+type transformedConn struct {
+	net.Conn
+	send    func([]byte) []byte
+	receive func([]byte) []byte
+}
+
+func (c transformedConn) Write(b []byte) (int, error) {
+	if c.send == nil {
+		return c.Conn.Write(b)
+	}
+	if _, err := c.Conn.Write(c.send(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c transformedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil || c.receive == nil {
+		return n, err
+	}
+	out := c.receive(b[:n])
+	if len(out) > len(b) {
+		return 0, fmt.Errorf("%w: transformed packet is %d bytes, buffer is %d", io.ErrShortBuffer, len(out), len(b))
+	}
+	return copy(b, out), nil
+}
+
+// sharedConn wraps a connection that outlives individual queries: either the one kept by a query
+// that reuses its source port, which is closed by Query.Close, or one supplied via WithConn.
+// Closing it is a no-op.
+type sharedConn struct {
+	net.Conn
+}
+
+func (sharedConn) Close() error {
+	return nil
+}
+
+// decodeField runs attemptDecodeANSI on a field and records the encoding that was applied to it.
+func (query *Query) decodeField(server *Server, field string, input []byte, extra []byte, language string) string {
+	if len(input) == 0 {
+		return ""
+	}
+
+	result, charset, confidence := query.decodeANSI(input, extra, language)
+	if charset != "" {
+		server.DetectedEncoding[field] = charset
+	}
+	if confidence > 0 {
+		if server.DetectionConfidence == nil {
+			server.DetectionConfidence = make(map[string]int)
+		}
+		server.DetectionConfidence[field] = confidence
+	}
+	return result
+}
+
+// readExtendedInfo reads the uint32 length-prefixed strings some open.mp builds append to the info
+// response, stopping at the first one that doesn't fit in what's left of the response or isn't
+// text, which is junk some servers pad their responses with rather than a field.
+func readExtendedInfo(trailing []byte) (fields []string) {
+	ptr := 0
+	for ptr+4 <= len(trailing) {
+		length := int(binary.LittleEndian.Uint32(trailing[ptr : ptr+4]))
+		ptr += 4
+		if length > len(trailing)-ptr || !isText(trailing[ptr:ptr+length]) {
+			break
+		}
+		fields = append(fields, string(trailing[ptr:ptr+length]))
+		ptr += length
+	}
+	return
+}
+
+// isText reports whether b is valid UTF-8 without any control characters.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildGuessHelper joins the non-empty fields into a single sample for charset detection, spaces
+// left behind by empty fields noticeably skew detection of short text.
+func buildGuessHelper(fields ...[]byte) []byte {
+	var present [][]byte
+	for _, field := range fields {
+		if len(field) > 0 {
+			present = append(present, field)
+		}
+	}
+	return bytes.Join(present, []byte(" "))
+}
+
+// attemptDecodeANSI decodes input into UTF-8, returning the decoded text and the name of the
+// encoding that was applied. The name is empty when input was left as-is.
+func (query *Query) attemptDecodeANSI(input []byte, extra []byte, language string) (result string, charset string) {
+	result, charset, _ = query.decodeANSI(input, extra, language)
 	return
 }
 
-func attemptDecodeANSI(input []byte, extra []byte, language string) (result string) {
+// decodeANSI is attemptDecodeANSI that also returns how confident charset detection was in the
+// encoding, from 1 to 100, or zero when it wasn't detected from the content.
+func (query *Query) decodeANSI(input []byte, extra []byte, language string) (result string, charset string, confidence int) {
+	// whatever happens below, never hand back invalid UTF-8, it breaks anything that serialises it
+	defer func() {
+		result = strings.ToValidUTF8(result, "\uFFFD")
+	}()
+
+	// UTF-16 would be mangled by any of the codepages below, so check for it first
+	if e, name := detectUTF16(input); e != nil {
+		decoded, err := e.NewDecoder().Bytes(input)
+		if err == nil {
+			return string(decoded), name, 0
+		}
+	}
+
 	// Fast path: If language is known, use the appropriate encoding
-	if encoding := getEncodingForLanguage(language); encoding != "" {
+	if encoding := query.encodingForLanguage(language); encoding != "" {
 		e, err := htmlindex.Get(encoding)
 		if err == nil {
 			dec := e.NewDecoder()
 			decoded, err := dec.Bytes(input)
 			if err == nil {
-				return string(decoded)
+				return string(decoded), encoding, 0
 			}
 		}
 	}
 
 	result = string(input)
-	detector, err := chardet.NewTextDetector().DetectBest(extra)
-	if err != nil {
+	detected, err := chardet.NewTextDetector().DetectAll(extra)
+	if err != nil || len(detected) == 0 {
 		return
 	}
-	e, err := htmlindex.Get(detector.Charset)
-	if err != nil {
+	detector := detected[0]
+	// a UTF-16 field elsewhere in the sample makes chardet guess UTF-16 for every field, input that
+	// isn't UTF-16 itself was already ruled out above
+	if strings.HasPrefix(detector.Charset, "UTF-16") || strings.HasPrefix(detector.Charset, "UTF-32") {
 		return
 	}
+	name := detector.Charset
+	if pinned, ok := query.pinnedEncoding(detected); ok {
+		name = pinned
+	}
+	if mapped, ok := chardetCharsets[name]; ok {
+		name = mapped
+	}
+	e, err := htmlindex.Get(name)
+	if err == nil {
+		charset, err = htmlindex.Name(e)
+	}
+	// htmlindex maps some legacy encodings to "replacement", which decodes everything to U+FFFD
+	if err != nil || charset == "replacement" {
+		if query.logger != nil {
+			query.logger.Warn("detected charset is unsupported, leaving text undecoded", "addr", query.addr, "charset", detector.Charset)
+		}
+		return result, "", 0
+	}
 	dec := e.NewDecoder()
 	decoded, err := dec.Bytes(input)
 	if err != nil {
-		return
+		return result, "", 0
 	}
-	return string(decoded)
+	return string(decoded), charset, detector.Confidence
 }
 
-// getEncodingForLanguage returns the appropriate encoding based on server language
-func getEncodingForLanguage(language string) string {
-	language = strings.ToLower(language)
+// chardetCharsets maps the names of charsets chardet detects onto the names htmlindex knows them by,
+// where the two differ.
+var chardetCharsets = map[string]string{
+	"GB-18030": "gb18030",
+}
 
-	// For Cyrillic languages
-	if language == "russian" || language == "ru" || language == "ru-ru" ||
-		language == "ukrainian" || language == "uk" || language == "uk-ua" ||
-		language == "belarusian" || language == "be" ||
-		language == "bulgarian" || language == "bg" ||
-		language == "macedonian" || language == "mk" ||
-		language == "serbian" || language == "sr" {
-		return "windows-1251"
+// pinnedEncoding returns the encoding pinned for the group of any of the charsets chardet ranked
+// best. On short input chardet often ranks several unrelated charsets equally and picks between
+// them by its own ordering, a pin makes the choice explicit.
+func (query *Query) pinnedEncoding(detected []chardet.Result) (string, bool) {
+	for _, result := range detected {
+		if result.Confidence < detected[0].Confidence {
+			break
+		}
+		if pinned, ok := query.pinnedEncodings[chardetGroups[result.Charset]]; ok {
+			return pinned, true
+		}
 	}
+	return "", false
+}
 
-	if language == "chinese" || language == "zh" || language == "zh-cn" || language == "zh-tw" {
-		return "gb18030"
-	}
+// chardetGroups maps the charsets chardet detects onto the language groups encodings can be pinned
+// for with WithPinnedEncoding.
+var chardetGroups = map[string]string{
+	"ISO-8859-1":   "latin",
+	"ISO-8859-2":   "central-european",
+	"ISO-8859-5":   "cyrillic",
+	"windows-1251": "cyrillic",
+	"KOI8-R":       "cyrillic",
+	"ISO-8859-6":   "arabic",
+	"windows-1256": "arabic",
+	"IBM420_rtl":   "arabic",
+	"IBM420_ltr":   "arabic",
+	"ISO-8859-7":   "greek",
+	"ISO-8859-8":   "hebrew",
+	"ISO-8859-8-I": "hebrew",
+	"IBM424_rtl":   "hebrew",
+	"IBM424_ltr":   "hebrew",
+	"ISO-8859-9":   "turkish",
+	"Shift_JIS":    "japanese",
+	"EUC-JP":       "japanese",
+	"ISO-2022-JP":  "japanese",
+	"GB-18030":     "chinese",
+	"Big5":         "chinese",
+	"ISO-2022-CN":  "chinese",
+	"EUC-KR":       "korean",
+	"ISO-2022-KR":  "korean",
+}
 
-	if language == "korean" || language == "ko" || language == "ko-kr" {
-		return "euc-kr"
+// detectUTF16 returns a UTF-16 encoding and its name for input that starts with a byte order mark
+// or looks like UTF-16 encoded Latin text, where every other byte is null. Returns nil otherwise.
+func detectUTF16(input []byte) (e encoding.Encoding, name string) {
+	if len(input) >= 2 {
+		if input[0] == 0xFF && input[1] == 0xFE {
+			return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+		}
+		if input[0] == 0xFE && input[1] == 0xFF {
+			return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+		}
 	}
 
-	if language == "japanese" || language == "ja" || language == "ja-jp" {
-		return "shift-jis"
+	if len(input) < 4 || len(input)%2 != 0 {
+		return nil, ""
 	}
 
-	if language == "polish" || language == "pl" ||
-		language == "czech" || language == "cs" ||
-		language == "slovak" || language == "sk" ||
-		language == "hungarian" || language == "hu" ||
-		language == "romanian" || language == "ro" {
-		return "windows-1250"
+	littleEndian, bigEndian := true, true
+	for i := 0; i < len(input); i += 2 {
+		if input[i] == 0 || input[i+1] != 0 {
+			littleEndian = false
+		}
+		if input[i] != 0 || input[i+1] == 0 {
+			bigEndian = false
+		}
 	}
 
-	if language == "turkish" || language == "tr" ||
-		language == "kurdish" || language == "ku" {
-		return "windows-1254"
+	if littleEndian {
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"
 	}
+	if bigEndian {
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"
+	}
+	return nil, ""
+}
+
+// languages maps the names and codes servers put in their language field to a short language code
+// and, for those that commonly use one, the legacy codepage their text is likely in.
+var languages = []struct {
+	code     string
+	encoding string
+	aliases  []string
+}{
+	// Cyrillic
+	{"ru", "windows-1251", []string{"russian", "ru-ru"}},
+	{"uk", "windows-1251", []string{"ukrainian", "uk-ua"}},
+	{"be", "windows-1251", []string{"belarusian"}},
+	{"bg", "windows-1251", []string{"bulgarian"}},
+	{"mk", "windows-1251", []string{"macedonian"}},
+	{"sr", "windows-1251", []string{"serbian"}},
+
+	{"zh", "gb18030", []string{"chinese", "zh-cn", "zh-tw"}},
+	{"ko", "euc-kr", []string{"korean", "ko-kr"}},
+	{"ja", "shift-jis", []string{"japanese", "ja-jp"}},
+
+	// Central European
+	{"pl", "windows-1250", []string{"polish"}},
+	{"cs", "windows-1250", []string{"czech"}},
+	{"sk", "windows-1250", []string{"slovak"}},
+	{"hu", "windows-1250", []string{"hungarian"}},
+	{"ro", "windows-1250", []string{"romanian"}},
+
+	{"tr", "windows-1254", []string{"turkish"}},
+	{"ku", "windows-1254", []string{"kurdish"}},
+	{"el", "windows-1253", []string{"greek"}},
+
+	{"he", "windows-1255", []string{"hebrew", "iw", "he-il"}},
+
+	// Baltic
+	{"lt", "windows-1257", []string{"lithuanian", "lt-lt"}},
+	{"lv", "windows-1257", []string{"latvian", "lv-lv"}},
+	{"et", "windows-1257", []string{"estonian", "et-ee"}},
+
+	{"ar", "windows-1256", []string{"arabic"}},
+	{"fa", "windows-1256", []string{"persian"}},
+	{"ur", "windows-1256", []string{"urdu"}},
+
+	{"th", "windows-874", []string{"thai", "th-th"}},
+	{"vi", "windows-1258", []string{"vietnamese", "vi-vn"}},
+
+	// no codepage hint, their text is usually plain ASCII or Windows-1252
+	{"en", "", []string{"english", "en-us", "en-gb"}},
+	{"es", "", []string{"spanish", "espanol", "español", "es-es"}},
+	{"pt", "", []string{"portuguese", "portugues", "português", "pt-br", "pt-pt"}},
+	{"de", "", []string{"german", "deutsch", "de-de"}},
+	{"fr", "", []string{"french", "francais", "français", "fr-fr"}},
+	{"it", "", []string{"italian", "italiano", "it-it"}},
+	{"nl", "", []string{"dutch", "nederlands", "nl-nl"}},
+}
 
-	if language == "greek" || language == "el" {
-		return "windows-1253"
+// lookupLanguage returns the index into languages of the given language name or code, or -1.
+func lookupLanguage(language string) int {
+	language = strings.ToLower(strings.TrimSpace(language))
+	for i, l := range languages {
+		if language == l.code {
+			return i
+		}
+		for _, alias := range l.aliases {
+			if language == alias {
+				return i
+			}
+		}
 	}
+	return -1
+}
 
-	if language == "arabic" || language == "ar" ||
-		language == "persian" || language == "fa" ||
-		language == "urdu" || language == "ur" {
-		return "windows-1256"
+// encodingForLanguage returns the encoding for the server language, preferring any set with
+// WithLanguageEncoding over the built-in table.
+func (query *Query) encodingForLanguage(language string) string {
+	if encoding, ok := query.languageEncodings[strings.ToLower(strings.TrimSpace(language))]; ok {
+		return encoding
 	}
+	return getEncodingForLanguage(language)
+}
 
+// getEncodingForLanguage returns the appropriate encoding based on server language
+func getEncodingForLanguage(language string) string {
+	if i := lookupLanguage(language); i >= 0 {
+		return languages[i].encoding
+	}
 	// If not recognized, return empty string
 	return ""
 }
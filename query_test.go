@@ -1,12 +1,28 @@
 package sampquery
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/saintfish/chardet"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/unicode/norm"
 )
 
 func TestGetServerInfo(t *testing.T) {
@@ -21,8 +37,8 @@ func TestGetServerInfo(t *testing.T) {
 	}{
 		{"valid", args{"server.ls-rp.com:7777", false}, ""},
 		{"valid", args{"46.174.54.184:7777", false}, ""},
-		{"invalid", args{"18.251.83.150:80", false}, "socket read timed out"},
-		{"invalid", args{"not a valid url", false}, "failed to resolve host: address not a valid url: missing port in address"},
+		{"invalid", args{"18.251.83.150:80", false}, "18.251.83.150:80: socket read timed out"},
+		{"invalid", args{"not a valid url", false}, "not a valid url: failed to resolve host: address not a valid url: missing port in address"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -43,6 +59,341 @@ func TestGetServerInfo(t *testing.T) {
 	}
 }
 
+func TestValidateHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr string
+	}{
+		{"127.0.0.1:7777", ""},
+		{"localhost:7777", ""},
+		{"127.0.0.1", "invalid address: address 127.0.0.1: missing port in address"},
+		{":7777", "address :7777 is missing a host"},
+		{"127.0.0.1:70000", "address 127.0.0.1:70000 has invalid port 70000"},
+		{"127.0.0.1:0", "address 127.0.0.1:0 has invalid port 0"},
+		{"127.0.0.1:http", "address 127.0.0.1:http has invalid port http"},
+		{"255.255.255.255:7777", "host 255.255.255.255:7777 resolved to broadcast address 255.255.255.255"},
+		{"224.0.0.1:7777", "host 224.0.0.1:7777 resolved to multicast address 224.0.0.1"},
+		{"0.0.0.0:7777", "host 0.0.0.0:7777 resolved to unspecified address 0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := ValidateHost(tt.host)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewQueryHostPort(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		addr string
+	}{
+		{"127.0.0.1", 7777, "127.0.0.1:7777"},
+		{"localhost", 8192, "localhost:8192"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			want, err := NewQuery(tt.addr)
+			assert.NoError(t, err)
+			got, err := NewQueryHostPort(tt.host, tt.port)
+			assert.NoError(t, err)
+			assert.Equal(t, want.addr.String(), got.addr.String())
+		})
+	}
+
+	_, err := NewQueryHostPort("::1", 7777)
+	assert.EqualError(t, err, "host [::1]:7777 resolved to IPv6 address ::1, only IPv4 is supported")
+}
+
+func TestNewQuery_NoHost(t *testing.T) {
+	_, err := NewQuery(":7777")
+	assert.EqualError(t, err, "host :7777 is missing an address to query")
+}
+
+func TestNewQuery_IPv6(t *testing.T) {
+	_, err := NewQuery("[::1]:7777")
+	assert.EqualError(t, err, "host [::1]:7777 resolved to IPv6 address ::1, only IPv4 is supported")
+}
+
+func TestNewQueryContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	_, err := NewQueryContext(ctx, "server.invalid:7777")
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	server, err := GetServerInfo(ctx, "server.invalid:7777", false)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, Server{}, server)
+}
+
+// blockingResolver blocks lookups until ctx is done, then fails them like a real resolver would.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, &net.DNSError{Err: "operation was canceled", Name: host}
+}
+
+func (blockingResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
+
+func TestNewQueryContext_CancelledMidLookup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewQueryContext(ctx, "samp.example.com:7777", WithResolver(blockingResolver{}))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	// and while waiting to retry a failed lookup
+	temporary := &net.DNSError{Err: "server misbehaving", Name: "samp.example.com", IsTemporary: true}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = NewQueryContext(ctx, "samp.example.com:7777",
+		WithResolver(&flakyResolver{failures: 2, err: temporary}),
+		WithResolveRetries(2, time.Second))
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+}
+
+func TestQuery_Reset(t *testing.T) {
+	mock := func(hostname string) string {
+		return mockServer(t, func(request []byte) []byte {
+			return buildResponse(request, buildInfoPayload(false, 1, 50, hostname, "gamemode", "English"))
+		})
+	}
+	first, second := mock("first"), mock("second")
+
+	for _, reuse := range []bool{false, true} {
+		t.Run(fmt.Sprint(reuse), func(t *testing.T) {
+			query, err := NewQuery(first, WithSourcePortReuse(reuse))
+			assert.NoError(t, err)
+			defer query.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, false)
+			assert.NoError(t, err)
+			assert.Equal(t, "first", server.Hostname)
+
+			assert.NoError(t, query.Reset(second))
+			assert.Equal(t, Server{}, query.Data)
+
+			server, err = query.GetInfo(ctx, false)
+			assert.NoError(t, err)
+			assert.Equal(t, "second", server.Hostname)
+
+			assert.Error(t, query.Reset("[::1]:7777"))
+			assert.Equal(t, second, query.addr.String())
+
+			query.Close()
+			assert.Equal(t, ErrClosed, query.Reset(first))
+		})
+	}
+}
+
+func TestGetServerInfo_ErrorIncludesHost(t *testing.T) {
+	// nothing answers on this port so the info query times out
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+	host := silent.LocalAddr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	server, err := GetServerInfo(ctx, host, false)
+	assert.EqualError(t, err, host+": socket read timed out")
+	assert.Equal(t, host, server.Address)
+}
+
+func TestGetServerInfo_ResolvedAddress(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"allow_DL", "1"}}))
+		case Ping:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+	_, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := GetServerInfo(ctx, "localhost:"+port, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:"+port, server.Address)
+	assert.Equal(t, "127.0.0.1:"+port, server.ResolvedAddress)
+}
+
+func TestGetServerInfo_OneConnection(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent []QueryType
+	)
+	addr := mockServer(t, func(request []byte) []byte {
+		mu.Lock()
+		sent = append(sent, QueryType(request[10]))
+		mu.Unlock()
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"weather", "10"}}))
+		case Ping, IsOmp:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	var dials int32
+	dialer := WithDialer(func(addr *net.UDPAddr) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.DialUDP("udp", nil, addr)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := GetServerInfo(ctx, addr, false, dialer)
+	assert.NoError(t, err)
+	assert.True(t, server.IsOmp)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []QueryType{Info, Rules, Ping, IsOmp}, sent)
+}
+
+func TestGetServerInfo_QueriedAt(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"allow_DL", "1"}}))
+		case Ping:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	before := time.Now()
+	server, err := GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.False(t, server.QueriedAt.Before(before))
+	assert.False(t, server.QueriedAt.After(time.Now()))
+}
+
+func TestGetServerInfoTimeout(t *testing.T) {
+	online := mockSAMPServer(t, nil)
+
+	server, err := GetServerInfoTimeout(online, time.Second, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.True(t, server.IsOmp)
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	start := time.Now()
+	_, err = GetServerInfoTimeout(silent.LocalAddr().String(), 100*time.Millisecond, false)
+	assert.EqualError(t, err, silent.LocalAddr().String()+": socket read timed out")
+	assert.True(t, time.Since(start) < time.Second, "timeout not respected")
+}
+
+func TestQuery_SendQuery_ShortResponse(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return request[:5]
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.SendQuery(ctx, Info)
+	assert.True(t, errors.Is(err, ErrShortResponse))
+	assert.EqualError(t, err, "response is less than 11 bytes: got 5")
+
+	_, err = GetServerInfo(ctx, addr, false)
+	assert.True(t, errors.Is(err, ErrShortResponse), "GetServerInfo should preserve the sentinel")
+}
+
+func TestIsOnline(t *testing.T) {
+	online := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, request[11:])
+	})
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"online", online, true},
+		{"offline", silent.LocalAddr().String(), false},
+		{"invalid", "not a valid url", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			assert.Equal(t, tt.want, IsOnline(ctx, tt.host))
+		})
+	}
+}
+
+func TestQuery_GetPingStats(t *testing.T) {
+	var count int32
+	addr := mockServer(t, func(request []byte) []byte {
+		// alternate between a fast and a slow reply
+		if atomic.AddInt32(&count, 1)%2 == 0 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	min, max, avg, jitter, err := query.GetPingStats(ctx, 6)
+	assert.NoError(t, err)
+	assert.True(t, min < 30*time.Millisecond, "min %v", min)
+	assert.True(t, max >= 30*time.Millisecond, "max %v", max)
+	assert.True(t, avg > min && avg < max, "avg %v", avg)
+	assert.True(t, jitter >= 20*time.Millisecond, "jitter %v", jitter)
+
+	_, _, _, _, err = query.GetPingStats(ctx, 0)
+	assert.Error(t, err)
+}
+
 func TestQuery_GetPing(t *testing.T) {
 	tests := []struct {
 		addr string
@@ -61,3 +412,1345 @@ func TestQuery_GetPing(t *testing.T) {
 		})
 	}
 }
+
+// mockServer starts a UDP listener on loopback which passes each request to handler and sends back
+// whatever it returns, a nil return drops the request. Returns the address to query.
+func mockServer(t *testing.T, handler func(request []byte) []byte) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if reply := handler(append([]byte(nil), buf[:n]...)); reply != nil {
+				conn.WriteToUDP(reply, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// sampReply answers info, rules and ping the way an open.mp server named "hostname" with one player
+// online does, for tests that just need a server to be there. Other queries go unanswered.
+func sampReply(request []byte) []byte {
+	switch QueryType(request[10]) {
+	case Info:
+		return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+	case Rules:
+		return buildResponse(request, buildRulesPayload([][2]string{{"version", "omp 1.2.0"}}))
+	case Ping:
+		return buildResponse(request, request[11:])
+	}
+	return nil
+}
+
+// mockSAMPServer starts a mock server answering with sampReply, except for the opcodes in overrides
+// which are answered by their handler instead.
+func mockSAMPServer(t *testing.T, overrides map[QueryType]func(request []byte) []byte) string {
+	return mockServer(t, func(request []byte) []byte {
+		if handler, ok := overrides[QueryType(request[10])]; ok {
+			return handler(request)
+		}
+		return sampReply(request)
+	})
+}
+
+// buildResponse echoes the 11 byte header of a request followed by payload.
+func buildResponse(request []byte, payload []byte) []byte {
+	return append(append([]byte(nil), request[:11]...), payload...)
+}
+
+func buildInfoPayload(password bool, players, maxPlayers int, hostname, gamemode, language string) []byte {
+	buf := new(bytes.Buffer)
+	if password {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(players))
+	binary.Write(buf, binary.LittleEndian, uint16(maxPlayers))
+	for _, field := range []string{hostname, gamemode, language} {
+		binary.Write(buf, binary.LittleEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	return buf.Bytes()
+}
+
+func buildRulesPayload(rules [][2]string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(rules)))
+	for _, rule := range rules {
+		buf.WriteByte(byte(len(rule[0])))
+		buf.WriteString(rule[0])
+		buf.WriteByte(byte(len(rule[1])))
+		buf.WriteString(rule[1])
+	}
+	return buf.Bytes()
+}
+
+func buildPlayersPayload(names []string, scores []int32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(names)))
+	for i, name := range names {
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+		binary.Write(buf, binary.LittleEndian, scores[i])
+	}
+	return buf.Bytes()
+}
+
+func TestQuery_GetRules_Truncated(t *testing.T) {
+	payload := buildRulesPayload([][2]string{{"mapname", "San Andreas"}, {"version", "0.3.7"}, {"weather", "10"}})
+	// cut off partway through the value of the last rule
+	payload = payload[:len(payload)-1]
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, payload)
+		case Ping, IsOmp:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rules, err := query.GetRules(ctx)
+	assert.Equal(t, ErrRulesTruncated, err)
+	assert.Equal(t, map[string]string{"mapname": "San Andreas", "version": "0.3.7"}, rules)
+
+	common, err := query.GetCommonRules(ctx)
+	assert.Equal(t, ErrRulesTruncated, err)
+	assert.Equal(t, "0.3.7", common.Version)
+
+	// GetServerInfo carries on with what it got
+	server, err := GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.Equal(t, rules, server.Rules)
+}
+
+func TestQuery_TrailingJunk(t *testing.T) {
+	// starts like a length-prefixed field so it would be read as one if nothing checked
+	junk := append([]byte{5, 0, 0, 0, 0x01, 0xfe, 0x80, 0x00, 0x7f}, bytes.Repeat([]byte{0xab}, 91)...)
+	withJunk := func(payload []byte) []byte {
+		return append(append(make([]byte, 11), payload...), junk...)
+	}
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	server, err := query.parseInfo(withJunk(buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English")), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.Equal(t, "English", server.Language)
+	assert.Equal(t, "", server.Discord)
+	assert.Equal(t, "", server.Website)
+
+	rules, err := query.parseRules(withJunk(buildRulesPayload([][2]string{{"version", "0.3.7"}, {"weather", "10"}})))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"version": "0.3.7", "weather": "10"}, rules)
+
+	// two byte value lengths are still told apart, the last value doesn't fit with one byte lengths
+	twoByte := new(bytes.Buffer)
+	binary.Write(twoByte, binary.LittleEndian, uint16(2))
+	for _, rule := range [][2]string{{"version", "omp 1.2.0"}, {"weburl", strings.Repeat("a", 300)}} {
+		twoByte.WriteByte(byte(len(rule[0])))
+		twoByte.WriteString(rule[0])
+		binary.Write(twoByte, binary.LittleEndian, uint16(len(rule[1])))
+		twoByte.WriteString(rule[1])
+	}
+	rules, err = query.parseRules(withJunk(twoByte.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"version": "omp 1.2.0", "weburl": strings.Repeat("a", 300)}, rules)
+
+	players, scores, err := query.parsePlayerList(withJunk(buildPlayersPayload([]string{"Southclaws", "Zeex"}, []int32{10, 20})))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Southclaws", "Zeex"}, players)
+	assert.Equal(t, []int{10, 20}, scores)
+
+	detailed := new(bytes.Buffer)
+	binary.Write(detailed, binary.LittleEndian, uint16(1))
+	detailed.Write([]byte{3, 4})
+	detailed.WriteString("Zeex")
+	binary.Write(detailed, binary.LittleEndian, int32(20))
+	binary.Write(detailed, binary.LittleEndian, uint32(45))
+	detailedPlayers, err := query.parseDetailedPlayers(withJunk(detailed.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, []Player{{ID: 3, Name: "Zeex", Score: 20, Ping: 45}}, detailedPlayers)
+}
+
+func TestQuery_GetRules_TwoByteValueLengths(t *testing.T) {
+	rules := [][2]string{
+		{"version", "omp 1.2.0"},
+		{"weburl", strings.Repeat("a", 300)},
+		{"mapname", "San Andreas"},
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(rules)))
+	for _, rule := range rules {
+		buf.WriteByte(byte(len(rule[0])))
+		buf.WriteString(rule[0])
+		binary.Write(buf, binary.LittleEndian, uint16(len(rule[1])))
+		buf.WriteString(rule[1])
+	}
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buf.Bytes())
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	parsed, err := query.GetRules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"version": "omp 1.2.0",
+		"weburl":  strings.Repeat("a", 300),
+		"mapname": "San Andreas",
+	}, parsed)
+}
+
+func TestQuery_GetRules_Large(t *testing.T) {
+	var rules [][2]string
+	for i := 0; i < 100; i++ {
+		rules = append(rules, [2]string{
+			fmt.Sprintf("artifact_%03d", i),
+			fmt.Sprintf("https://cdn.example.com/models/%03d.dff", i),
+		})
+	}
+	payload := buildRulesPayload(rules)
+	assert.True(t, len(payload) > 2048, "payload should exceed the old buffer size")
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	got, err := query.GetRules(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, got, len(rules))
+	for _, rule := range rules {
+		assert.Equal(t, rule[1], got[rule[0]])
+	}
+}
+
+func TestServer_String(t *testing.T) {
+	server := Server{
+		Hostname:   "Scavenge and Survive",
+		Players:    12,
+		MaxPlayers: 50,
+		Gamemode:   "ScavengeSurvive",
+		Ping:       int(42 * time.Millisecond),
+		IsOmp:      true,
+	}
+	assert.Equal(t, "Scavenge and Survive (12/50) [ScavengeSurvive] ping=42ms omp=true", server.String())
+}
+
+func TestServer_FillPercent(t *testing.T) {
+	assert.Equal(t, 25.0, Server{Players: 12, MaxPlayers: 48}.FillPercent())
+	assert.Equal(t, 100.0, Server{Players: 50, MaxPlayers: 50}.FillPercent())
+	assert.Equal(t, 0.0, Server{Players: 0, MaxPlayers: 0}.FillPercent())
+	assert.Equal(t, 0.0, Server{Players: 5, MaxPlayers: 0}.FillPercent())
+}
+
+func TestServer_LanguageCode(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"Russian", "ru"},
+		{"RU-ru", "ru"},
+		{" Português ", "pt"},
+		{"zh-TW", "zh"},
+		{"-", ""},
+		{"Klingon", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Server{Language: tt.language}.LanguageCode(), tt.language)
+	}
+}
+
+func TestServer_ToMap(t *testing.T) {
+	server := Server{
+		Address:          "127.0.0.1:7777",
+		Hostname:         "Scavenge and Survive",
+		Players:          12,
+		MaxPlayers:       50,
+		Gamemode:         "ScavengeSurvive",
+		Language:         "English",
+		Password:         true,
+		Rules:            map[string]string{"mapname": "San Andreas", "weather": "10"},
+		Ping:             int(42 * time.Millisecond),
+		IsOmp:            true,
+		DetectedEncoding: map[string]string{"hostname": "windows-1252"},
+		RawHostname:      []byte("Scavenge and Survive"),
+		RawGamemode:      []byte("ScavengeSurvive"),
+		RawLanguage:      []byte{0xc0, 0xed, 0xe3, 0xeb},
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"address":                    "127.0.0.1:7777",
+		"hostname":                   "Scavenge and Survive",
+		"players":                    12,
+		"max_players":                50,
+		"gamemode":                   "ScavengeSurvive",
+		"language":                   "English",
+		"password":                   true,
+		"ping":                       int(42 * time.Millisecond),
+		"isOmp":                      true,
+		"omp_version":                "",
+		"resolved_address":           "",
+		"discord":                    "",
+		"website":                    "",
+		"queried_at":                 time.Time{},
+		"raw_hostname":               "Scavenge and Survive",
+		"raw_gamemode":               "ScavengeSurvive",
+		"raw_language":               "\xc0\xed\xe3\xeb",
+		"detected_encoding.hostname": "windows-1252",
+		"rules.mapname":              "San Andreas",
+		"rules.weather":              "10",
+	}, server.ToMap())
+}
+
+func TestQuery_GetInfo_Challenge(t *testing.T) {
+	token := []byte{0xde, 0xad, 0xbe, 0xef}
+	var challenged int32
+
+	addr := mockServer(t, func(request []byte) []byte {
+		if QueryType(request[10]) != Info {
+			return nil
+		}
+		if len(request) == 11 {
+			atomic.AddInt32(&challenged, 1)
+			response := buildResponse(request, token)
+			response[10] = byte(Challenge)
+			return response
+		}
+		if !bytes.Equal(request[11:], token) {
+			return nil
+		}
+		return buildResponse(request, buildInfoPayload(false, 3, 50, "hostname", "gamemode", "English"))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&challenged))
+	assert.Equal(t, "hostname", server.Hostname)
+	assert.Equal(t, "gamemode", server.Gamemode)
+	assert.Equal(t, 3, server.Players)
+	assert.Equal(t, 50, server.MaxPlayers)
+}
+
+func TestQuery_GetInfo_PasswordByte(t *testing.T) {
+	tests := []struct {
+		value byte
+		want  bool
+	}{
+		{0, false},
+		{1, true},
+		{2, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.value), func(t *testing.T) {
+			addr := mockServer(t, func(request []byte) []byte {
+				payload := buildInfoPayload(false, 0, 50, "hostname", "gamemode", "English")
+				payload[0] = tt.value
+				return buildResponse(request, payload)
+			})
+
+			query, err := NewQuery(addr)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, false)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, server.Password)
+		})
+	}
+}
+
+func TestQuery_Clone(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 5, 50, "hostname", "gamemode", "English"))
+	})
+
+	template, err := NewQuery(addr, WithReadBufferSize(1024))
+	assert.NoError(t, err)
+
+	clone := template.Clone()
+	assert.Equal(t, template.addr, clone.addr)
+	assert.Equal(t, template.bufferSize, clone.bufferSize)
+	clone.addr.Port++
+	assert.NotEqual(t, template.addr.Port, clone.addr.Port, "clones must not share an address")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server, err := template.Clone().GetInfo(ctx, false)
+			if err == nil && server.Hostname != "hostname" {
+				err = fmt.Errorf("unexpected hostname %q", server.Hostname)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestQuery_GetInfo_UTF16Hostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding encoding.Encoding
+	}{
+		{"little endian", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+		{"little endian bom", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)},
+		{"big endian bom", unicode.UTF16(unicode.BigEndian, unicode.UseBOM)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, err := tt.encoding.NewEncoder().String("Grand Larceny Roleplay")
+			assert.NoError(t, err)
+
+			addr := mockServer(t, func(request []byte) []byte {
+				return buildResponse(request, buildInfoPayload(false, 0, 50, hostname, "gamemode", "English"))
+			})
+
+			query, err := NewQuery(addr)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, true)
+			assert.NoError(t, err)
+			assert.Equal(t, "Grand Larceny Roleplay", server.Hostname)
+			assert.Equal(t, "gamemode", server.Gamemode)
+		})
+	}
+}
+
+func TestBuildGuessHelper(t *testing.T) {
+	hostname, err := charmap.Windows1251.NewEncoder().Bytes([]byte("Привет"))
+	assert.NoError(t, err)
+
+	polluted := bytes.Join([][]byte{hostname, nil, nil}, []byte(" "))
+	clean := buildGuessHelper(hostname, nil, nil)
+	assert.Equal(t, hostname, clean)
+
+	cleanResult, err := chardet.NewTextDetector().DetectBest(clean)
+	assert.NoError(t, err)
+	pollutedResult, err := chardet.NewTextDetector().DetectBest(polluted)
+	assert.NoError(t, err)
+	assert.Equal(t, "windows-1251", cleanResult.Charset)
+	assert.True(t, cleanResult.Confidence >= pollutedResult.Confidence,
+		"clean sample confidence %d lower than polluted %d", cleanResult.Confidence, pollutedResult.Confidence)
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	decoded, charset := query.attemptDecodeANSI(hostname, clean, "")
+	assert.Equal(t, "Привет", decoded)
+	assert.Equal(t, "windows-1251", charset)
+	assert.Equal(t, []byte("a b"), buildGuessHelper([]byte("a"), nil, []byte("b")))
+}
+
+func TestQuery_GetInfo_DetectedEncoding(t *testing.T) {
+	hostname, err := charmap.Windows1251.NewEncoder().String("Русский сервер")
+	assert.NoError(t, err)
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 0, 50, hostname, "RP", "Russian"))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := query.GetInfo(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Русский сервер", server.Hostname)
+	assert.Equal(t, "windows-1251", server.DetectedEncoding["hostname"])
+	assert.Equal(t, "windows-1251", server.DetectedEncoding["gamemode"])
+
+	server, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	assert.Nil(t, server.DetectedEncoding)
+}
+
+func TestQuery_GetInfo_DetectionConfidence(t *testing.T) {
+	hostname, err := charmap.Windows1251.NewEncoder().String("Добро пожаловать на русский сервер ролевой игры")
+	assert.NoError(t, err)
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	// no language, so the encoding has to be detected
+	server, err := query.parseInfo(append(make([]byte, 11), buildInfoPayload(false, 0, 50, hostname, "RP", "")...), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Добро пожаловать на русский сервер ролевой игры", server.Hostname)
+	assert.Equal(t, "windows-1251", server.DetectedEncoding["hostname"])
+	confidence := server.DetectionConfidence["hostname"]
+	assert.True(t, confidence > 0 && confidence <= 100, "confidence %d", confidence)
+
+	// with the language known nothing is detected
+	server, err = query.parseInfo(append(make([]byte, 11), buildInfoPayload(false, 0, 50, hostname, "RP", "Russian")...), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "windows-1251", server.DetectedEncoding["hostname"])
+	assert.Nil(t, server.DetectionConfidence)
+}
+
+func TestQuery_parseDetailedPlayers(t *testing.T) {
+	fixture := []byte{
+		'S', 'A', 'M', 'P', 127, 0, 0, 1, 0x61, 0x1e, 'd',
+		0x02, 0x00, // 2 players
+		0x00, 0x0a, 'S', 'o', 'u', 't', 'h', 'c', 'l', 'a', 'w', 's', // id 0, name
+		0x39, 0x05, 0x00, 0x00, // score 1337
+		0x2a, 0x00, 0x00, 0x00, // ping 42
+		0x07, 0x06, 'Y', '_', 'L', 'e', 's', 's', // id 7, name
+		0xf6, 0xff, 0xff, 0xff, // score -10
+		0xfa, 0x00, 0x00, 0x00, // ping 250
+	}
+
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	players, err := query.parseDetailedPlayers(fixture)
+	assert.NoError(t, err)
+	assert.Equal(t, []Player{
+		{ID: 0, Name: "Southclaws", Score: 1337, Ping: 42},
+		{ID: 7, Name: "Y_Less", Score: -10, Ping: 250},
+	}, players)
+
+	_, err = query.parseDetailedPlayers(fixture[:len(fixture)-3])
+	assert.EqualError(t, err, "detailed player response truncated at player 1")
+}
+
+func TestQuery_attemptDecodeANSI_InvalidUTF8(t *testing.T) {
+	query, err := NewQuery("127.0.0.1:7777")
+	assert.NoError(t, err)
+
+	// ISO-2022-KR can't be decoded so the input comes back as it is, apart from the invalid byte
+	input := "\x1b$)C\x0e\x21\x21\x0f hello \xff"
+	decoded, charset := query.attemptDecodeANSI([]byte(input), []byte(input), "")
+	assert.Equal(t, "", charset)
+	assert.True(t, utf8.ValidString(decoded))
+	assert.Equal(t, "\x1b$)C\x0e\x21\x21\x0f hello \uFFFD", decoded)
+}
+
+func TestQuery_attemptDecodeANSI_Charsets(t *testing.T) {
+	buf := new(bytes.Buffer)
+	query, err := NewQuery("127.0.0.1:7777", WithLogger(slog.New(slog.NewTextHandler(buf, nil))))
+	assert.NoError(t, err)
+
+	// chardet reports GB-18030, which htmlindex only knows as gb18030
+	chinese, err := simplifiedchinese.GB18030.NewEncoder().String("欢迎来到中文角色扮演服务器")
+	assert.NoError(t, err)
+	decoded, charset := query.attemptDecodeANSI([]byte(chinese), []byte(chinese), "")
+	assert.Equal(t, "欢迎来到中文角色扮演服务器", decoded)
+	assert.Equal(t, "gb18030", charset)
+	assert.Empty(t, buf.String())
+
+	// ISO-2022-KR has no usable decoder, so the input should come back untouched
+	korean := "\x1b$)C\x0e\x21\x21\x0f hello"
+	decoded, charset = query.attemptDecodeANSI([]byte(korean), []byte(korean), "")
+	assert.Equal(t, korean, decoded)
+	assert.Equal(t, "", charset)
+	assert.Contains(t, buf.String(), "detected charset is unsupported")
+	assert.Contains(t, buf.String(), "charset=ISO-2022-KR")
+}
+
+func TestQuery_attemptDecodeANSI_Languages(t *testing.T) {
+	tests := []struct {
+		language string
+		encoding *charmap.Charmap
+		hostname string
+		want     string
+	}{
+		{"Hebrew", charmap.Windows1255, "שרת רולפליי ישראלי", "windows-1255"},
+		{"Lithuanian", charmap.Windows1257, "Žaidimų serveris Ąžuolas", "windows-1257"},
+		{"Thai", charmap.Windows874, "เซิร์ฟเวอร์ไทย", "windows-874"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			query, err := NewQuery("127.0.0.1:7777")
+			assert.NoError(t, err)
+
+			input, err := tt.encoding.NewEncoder().String(tt.hostname)
+			assert.NoError(t, err)
+
+			decoded, charset := query.attemptDecodeANSI([]byte(input), []byte(input), tt.language)
+			assert.Equal(t, tt.hostname, decoded)
+			assert.Equal(t, tt.want, charset)
+		})
+	}
+
+	// windows-1258 writes most Vietnamese tones as combining marks after the base letter
+	t.Run("Vietnamese", func(t *testing.T) {
+		query, err := NewQuery("127.0.0.1:7777")
+		assert.NoError(t, err)
+
+		input := []byte("M\xe1y chu\xd2 Vi\xea\xf2t Nam")
+		decoded, charset := query.attemptDecodeANSI(input, input, "Vietnamese")
+		assert.Equal(t, "Máy chủ Việt Nam", norm.NFC.String(decoded))
+		assert.Equal(t, "windows-1258", charset)
+	})
+}
+
+func TestQuery_Close(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 0, 50, "hostname", "gamemode", "English"))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NotPanics(t, func() {
+				assert.NoError(t, query.Close())
+			})
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, query.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.Equal(t, ErrClosed, err)
+
+	// clones get their own lifecycle
+	_, err = query.Clone().GetInfo(ctx, false)
+	assert.NoError(t, err)
+}
+
+func TestQuery_Close_InFlight(t *testing.T) {
+	// a server that never answers, so the query is still reading when Close is called
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	query, err := NewQuery(conn.LocalAddr().String(), WithSourcePortReuse(true))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := query.GetInfo(ctx, false)
+		done <- err
+	}()
+
+	// wait for the read to start before closing
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadFromUDP(buf)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, query.Close())
+	assert.True(t, time.Since(start) < time.Second, "Close took %v", time.Since(start))
+
+	select {
+	case err = <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("query still running after Close")
+	}
+}
+
+func TestQuery_Close_InFlightRetries(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	query, err := NewQuery(conn.LocalAddr().String(), WithSourcePortReuse(true), WithRetries(5))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := query.GetInfo(ctx, false)
+		done <- err
+	}()
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadFromUDP(buf)
+	assert.NoError(t, err)
+
+	// the cancelled read isn't mistaken for a timeout and retried
+	start := time.Now()
+	assert.NoError(t, query.Close())
+	assert.True(t, time.Since(start) < closeWait, "Close took %v", time.Since(start))
+	assert.Equal(t, ErrClosed, <-done)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = conn.ReadFromUDP(buf)
+	assert.True(t, isTimeout(err), "got another packet after Close")
+}
+
+// stuckConn is a connection whose reads ignore deadlines and only return once it's closed.
+type stuckConn struct {
+	net.Conn
+	reading chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *stuckConn) Read(b []byte) (int, error) {
+	close(c.reading)
+	<-c.done
+	return 0, net.ErrClosed
+}
+
+func (c *stuckConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *stuckConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// slowResolver resolves every host to loopback after signalling that it started and sleeping.
+type slowResolver struct {
+	started chan struct{}
+}
+
+func (r slowResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	close(r.started)
+	time.Sleep(20 * time.Millisecond)
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func (r slowResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
+
+func TestQuery_Close_RacingReset(t *testing.T) {
+	conn := &stuckConn{reading: make(chan struct{}), done: make(chan struct{})}
+	resolver := slowResolver{started: make(chan struct{})}
+	query, err := NewQuery("127.0.0.1:7777", WithSourcePortReuse(true), WithResolver(resolver),
+		WithDialer(func(addr *net.UDPAddr) (net.Conn, error) {
+			udp, err := net.DialUDP("udp", nil, addr)
+			conn.Conn = udp
+			return conn, err
+		}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	queried := make(chan error, 1)
+	go func() {
+		_, err := query.GetInfo(ctx, false)
+		queried <- err
+	}()
+	<-conn.reading
+
+	reset := make(chan error, 1)
+	go func() { reset <- query.Reset("samp.example.com:7777") }()
+	<-resolver.started
+
+	// Close waits on the stuck read while Reset gets to the connection
+	assert.NotPanics(t, func() { query.Close() })
+	assert.Equal(t, ErrClosed, <-reset)
+	assert.Error(t, <-queried)
+
+	// nothing opens a connection after Close
+	_, err = query.openConnection()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestQuery_GetInfo_Extended(t *testing.T) {
+	extended := func(fields ...string) []byte {
+		payload := buildInfoPayload(false, 4, 50, "hostname", "gamemode", "English")
+		for _, field := range fields {
+			payload = append(payload, byte(len(field)), 0, 0, 0)
+			payload = append(payload, field...)
+		}
+		return payload
+	}
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		wantDiscord string
+		wantWebsite string
+	}{
+		{"absent", extended(), "", ""},
+		{"discord", extended("discord.gg/samp"), "discord.gg/samp", ""},
+		{"both", extended("discord.gg/samp", "https://open.mp"), "discord.gg/samp", "https://open.mp"},
+		{"truncated", extended("discord.gg/samp", "https://open.mp")[:70], "discord.gg/samp", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := mockServer(t, func(request []byte) []byte {
+				return buildResponse(request, tt.payload)
+			})
+
+			query, err := NewQuery(addr)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			server, err := query.GetInfo(ctx, false)
+			assert.NoError(t, err)
+			assert.Equal(t, "hostname", server.Hostname)
+			assert.Equal(t, tt.wantDiscord, server.Discord)
+			assert.Equal(t, tt.wantWebsite, server.Website)
+		})
+	}
+}
+
+func TestQuery_GetInfo_EmptyHostname(t *testing.T) {
+	gamemode, err := charmap.Windows1251.NewEncoder().String("Дрифт")
+	assert.NoError(t, err)
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 0, 50, "", gamemode, "Russian"))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server, err := query.GetInfo(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "", server.Hostname)
+	assert.Equal(t, "Дрифт", server.Gamemode)
+	assert.NotContains(t, server.DetectedEncoding, "hostname", "decoder should not run on an empty field")
+	assert.Equal(t, "windows-1251", server.DetectedEncoding["gamemode"])
+}
+
+func TestQuery_BuildQueryPacket(t *testing.T) {
+	query, err := NewQuery("192.168.1.20:7777")
+	assert.NoError(t, err)
+
+	header := []byte{'S', 'A', 'M', 'P', 192, 168, 1, 20, 0x61, 0x1e}
+
+	for _, opcode := range []QueryType{Info, Rules, Players, DetailedPlayers} {
+		t.Run(string(rune(opcode)), func(t *testing.T) {
+			packet, err := query.BuildQueryPacket(opcode)
+			assert.NoError(t, err)
+			assert.Equal(t, append(append([]byte(nil), header...), byte(opcode)), packet)
+		})
+	}
+
+	for _, opcode := range []QueryType{Ping, IsOmp} {
+		t.Run(string(rune(opcode)), func(t *testing.T) {
+			packet, err := query.BuildQueryPacket(opcode)
+			assert.NoError(t, err)
+			assert.Len(t, packet, 15)
+			assert.Equal(t, header, packet[:10])
+			assert.Equal(t, byte(opcode), packet[10])
+
+			again, err := query.BuildQueryPacket(opcode)
+			assert.NoError(t, err)
+			assert.NotEqual(t, packet[11:], again[11:], "random suffix should differ between packets")
+		})
+	}
+}
+
+func TestQuery_GetInfo_BadLength(t *testing.T) {
+	payload := buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English")
+	// the gamemode length follows the 5 count bytes, 4 hostname length bytes and the hostname
+	binary.LittleEndian.PutUint32(payload[5+4+len("hostname"):], 0xffff)
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.EqualError(t, err, "info response gamemode length 65535 exceeds the 19 bytes remaining")
+}
+
+func FuzzParseInfo(f *testing.F) {
+	header := []byte{'S', 'A', 'M', 'P', 127, 0, 0, 1, 0x61, 0x1e, 'i'}
+	f.Add(buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+	f.Add(buildInfoPayload(true, 0, 0, "", "", ""))
+	f.Add([]byte{})
+
+	query, err := NewQuery("127.0.0.1:7777")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		response := append(append([]byte{}, header...), payload...)
+		query.parseInfo(response, true)
+	})
+}
+
+func TestQuery_ConnRefused(t *testing.T) {
+	// grab a free port then close it so nothing is listening there
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	addr := closed.LocalAddr().String()
+	closed.Close()
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.True(t, errors.Is(err, ErrConnRefused), "got %v", err)
+}
+
+func TestQuery_BytesRead(t *testing.T) {
+	info := buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English")
+	rules := buildRulesPayload([][2]string{{"weather", "10"}})
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, info)
+		case Rules:
+			return buildResponse(request, rules)
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, query.BytesRead(Info))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	_, err = query.GetRules(ctx)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 11+len(info), query.BytesRead(Info))
+	assert.Equal(t, 11+len(rules), query.BytesRead(Rules))
+	assert.Equal(t, 0, query.BytesRead(Players))
+}
+
+func TestQuery_SendQuery_WrongPort(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		response := buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		binary.LittleEndian.PutUint16(response[8:10], 7778)
+		return response
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.EqualError(t, err, fmt.Sprintf("response is for port 7778, expected %d", query.addr.Port))
+}
+
+func TestQuery_GetPlayers_Truncated(t *testing.T) {
+	payload := buildPlayersPayload([]string{"Southclaws", "Y_Less"}, []int32{10, 20})
+	// cut the response off right after the second player's name
+	payload = payload[:len(payload)-4]
+
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var players []string
+	assert.NotPanics(t, func() {
+		players, err = query.GetPlayers(ctx)
+	})
+	assert.EqualError(t, err, "player response truncated at player 1")
+	assert.Equal(t, []string{"Southclaws"}, players)
+}
+
+func TestQuery_GetPlayerScores(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildPlayersPayload(
+			[]string{"Southclaws", "Y_Less", "Southclaws", "Kalcor"},
+			[]int32{10, 20, 30, -5},
+		))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	scores, err := query.GetPlayerScores(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"Southclaws": 30, "Y_Less": 20, "Kalcor": -5}, scores)
+}
+
+func TestQuery_GetOmpVersion(t *testing.T) {
+	version := "1.3.1.2748"
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Rules:
+			return buildResponse(request, buildRulesPayload([][2]string{{"weather", "10"}}))
+		case Ping:
+			return buildResponse(request, request[11:])
+		case IsOmp:
+			payload := append([]byte{}, request[11:]...)
+			payload = binary.LittleEndian.AppendUint32(payload, uint32(len(version)))
+			return buildResponse(request, append(payload, version...))
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	isOmp, got := query.GetOmpVersion(ctx)
+	assert.True(t, isOmp)
+	assert.Equal(t, version, got)
+
+	server, err := GetServerInfo(ctx, addr, false)
+	assert.NoError(t, err)
+	assert.True(t, server.IsOmp)
+	assert.Equal(t, version, server.OmpVersion)
+}
+
+func TestQuery_GetOmpVersion_EchoOnly(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	isOmp, version := query.GetOmpVersion(ctx)
+	assert.True(t, isOmp)
+	assert.Equal(t, "", version)
+}
+
+func TestQuery_GetOmpInfo(t *testing.T) {
+	version := "1.4.0.2779"
+	var echoOnly int32
+	addr := mockServer(t, func(request []byte) []byte {
+		payload := append([]byte{}, request[11:]...)
+		if atomic.LoadInt32(&echoOnly) == 1 {
+			return buildResponse(request, payload)
+		}
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(version)))
+		payload = append(payload, version...)
+		payload = binary.LittleEndian.AppendUint16(payload, 12)
+		payload = binary.LittleEndian.AppendUint16(payload, 500)
+		return buildResponse(request, payload)
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	isOmp, info := query.GetOmpInfo(ctx)
+	assert.True(t, isOmp)
+	assert.Equal(t, OmpInfo{Version: version, Players: 12, MaxPlayers: 500, HasCounts: true}, info)
+
+	atomic.StoreInt32(&echoOnly, 1)
+	isOmp, info = query.GetOmpInfo(ctx)
+	assert.True(t, isOmp)
+	assert.Equal(t, OmpInfo{}, info)
+}
+
+func TestQuery_GetInfoBefore(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	server, err := query.GetInfoBefore(time.Now().Add(time.Second), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname", server.Hostname)
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	query, err = NewQuery(silent.LocalAddr().String())
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = query.GetInfoBefore(start.Add(100*time.Millisecond), false)
+	assert.EqualError(t, err, "socket read timed out")
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestQuery_StreamPlayers(t *testing.T) {
+	var (
+		names  []string
+		scores []int32
+	)
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("player%d", i))
+		scores = append(scores, int32(i))
+	}
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildPlayersPayload(names, scores))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	streamed := make(map[string]int)
+	err = query.StreamPlayers(ctx, func(name string, score int) error {
+		streamed[name] = score
+		if len(streamed) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, map[string]int{"player0": 0, "player1": 1, "player2": 2}, streamed)
+}
+
+func TestQuery_SendQuery_Token(t *testing.T) {
+	var spoof int32
+	addr := mockServer(t, func(request []byte) []byte {
+		if atomic.LoadInt32(&spoof) == 1 {
+			return buildResponse(request, []byte{0, 0, 0, 0})
+		}
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr, WithRandReader(bytes.NewReader([]byte{9, 8, 7, 6, 5, 4, 3, 2})))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	response, err := query.SendQuery(ctx, Ping)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{9, 8, 7, 6}, response[11:15])
+
+	// the spoofed reply is skipped and the query waits for the real one, which never comes
+	atomic.StoreInt32(&spoof, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = query.SendQuery(ctx, Ping)
+	assert.Equal(t, ErrTokenMismatch, err)
+}
+
+func TestQuery_SendQuery_LateReplyReusedConn(t *testing.T) {
+	var calls int32
+	addr := mockServer(t, func(request []byte) []byte {
+		// the first ping is answered only after its caller has given up on it
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr, WithSourcePortReuse(true))
+	assert.NoError(t, err)
+	defer query.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = query.GetPing(ctx)
+	assert.Error(t, err)
+
+	// let the late reply land on the socket before the next ping is sent
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = query.GetPing(ctx)
+	assert.NoError(t, err)
+}
+
+func TestQuery_SendQuery_TokenPerAttempt(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// ignores the first attempt until the retry arrives, then answers both, the first one twice
+	go func() {
+		buf := make([]byte, 64)
+		var requests [][]byte
+		for len(requests) < 2 {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			requests = append(requests, append([]byte{}, buf[:n]...))
+			if len(requests) == 2 {
+				conn.WriteToUDP(buildResponse(requests[0], requests[0][11:]), from)
+				conn.WriteToUDP(buildResponse(requests[0], requests[0][11:]), from)
+				time.Sleep(20 * time.Millisecond)
+				conn.WriteToUDP(buildResponse(requests[1], requests[1][11:]), from)
+			}
+		}
+	}()
+
+	query, err := NewQuery(conn.LocalAddr().String(),
+		WithRetries(1),
+		WithRetryBackoff(100*time.Millisecond, 2),
+		WithRandReader(bytes.NewReader([]byte{1, 1, 1, 1, 2, 2, 2, 2})))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	response, err := query.SendQuery(ctx, Ping)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2, 2, 2, 2}, response[11:15])
+}
+
+func TestQuery_Answered(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		switch QueryType(request[10]) {
+		case Info:
+			return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+		case Ping:
+			return buildResponse(request, request[11:])
+		}
+		return nil
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, map[QueryType]bool{}, query.Answered())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+
+	rulesCtx, rulesCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer rulesCancel()
+	_, err = query.GetRules(rulesCtx)
+	assert.Error(t, err)
+
+	_, err = query.GetPing(ctx)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[QueryType]bool{Info: true, Rules: false, Ping: true}, query.Answered())
+
+	// the result of GetServerInfo carries the same, up to the first failure
+	infoCtx, infoCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer infoCancel()
+	server, err := GetServerInfo(infoCtx, addr, false)
+	assert.Error(t, err)
+	assert.Equal(t, map[QueryType]bool{Info: true, Rules: false}, server.Answered)
+
+	encoded, err := json.Marshal(server.Answered)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"info":true,"rules":false}`, string(encoded))
+
+	var decoded map[QueryType]bool
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, server.Answered, decoded)
+}
+
+func TestQuery_GetPingMillis(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		time.Sleep(50 * time.Millisecond)
+		return buildResponse(request, request[11:])
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ping, err := query.GetPingMillis(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ping >= 50 && ping < 100, "ping %dms", ping)
+}
+
+func TestQueryType_String(t *testing.T) {
+	for opcode, want := range map[QueryType]string{
+		Info:            "info",
+		Rules:           "rules",
+		Players:         "players",
+		Ping:            "ping",
+		DetailedPlayers: "detailed players",
+		IsOmp:           "omp",
+		RCON:            "rcon",
+		Challenge:       "challenge",
+		QueryType('z'):  "z",
+	} {
+		assert.Equal(t, want, opcode.String())
+	}
+}
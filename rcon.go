@@ -0,0 +1,106 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rconIdle is how long SendRCON waits for another line of output before deciding the server has
+// finished replying. The protocol has no end marker, each line arrives as its own packet.
+const rconIdle = 250 * time.Millisecond
+
+// SendRCON runs command on the server as a remote admin, authenticating with password, and returns
+// its output with each line the server sent separated by a newline. Servers don't reply at all to a
+// wrong password, so that surfaces as a timeout once ctx is done.
+func (query *Query) SendRCON(ctx context.Context, password, command string) (output string, err error) {
+	if len(password) > 0xffff || len(command) > 0xffff {
+		return "", errors.New("rcon password or command is too long")
+	}
+
+	request, err := query.BuildQueryPacket(RCON)
+	if err != nil {
+		return
+	}
+	buf := bytes.NewBuffer(request)
+	binary.Write(buf, binary.LittleEndian, uint16(len(password)))
+	buf.WriteString(password)
+	binary.Write(buf, binary.LittleEndian, uint16(len(command)))
+	buf.WriteString(command)
+
+	conn, err := query.openConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write")
+	}
+	if query.logger != nil {
+		query.logger.Debug("sent query", "addr", query.addr, "opcode", RCON.String(), "bytes", buf.Len())
+	}
+
+	type resultData struct {
+		lines []string
+		err   error
+	}
+	waitResult := make(chan resultData, 1)
+
+	query.beginRead()
+	go func() {
+		defer query.endRead()
+		var lines []string
+		// block on the first line until ctx is done, after that a short gap means the output ended
+		conn.SetReadDeadline(time.Time{})
+		for {
+			response := query.newReadBuffer(query.bufferSize)
+			n, errInner := conn.Read(response)
+			if errInner != nil {
+				if len(lines) > 0 {
+					break
+				}
+				waitResult <- resultData{err: readError(errInner)}
+				return
+			}
+			if errInner = query.checkResponseSize(n); errInner != nil {
+				waitResult <- resultData{err: errInner}
+				return
+			}
+			if n < 13 || !query.hasMagic(response) || QueryType(response[10]) != RCON {
+				continue
+			}
+
+			length := int(binary.LittleEndian.Uint16(response[11:13]))
+			if length > n-13 {
+				waitResult <- resultData{err: errors.Errorf("rcon response line length %d exceeds the %d bytes remaining", length, n-13)}
+				return
+			}
+			lines = append(lines, string(response[13:13+length]))
+			conn.SetReadDeadline(time.Now().Add(rconIdle))
+		}
+		conn.SetReadDeadline(time.Time{})
+		waitResult <- resultData{lines: lines}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// stop the read so the goroutine doesn't outlive this call on a shared socket
+		conn.SetReadDeadline(time.Now())
+		result := <-waitResult
+		if len(result.lines) > 0 {
+			return strings.Join(result.lines, "\n"), nil
+		}
+		return "", ErrTimeout
+	case result := <-waitResult:
+		if result.err != nil {
+			return "", result.err
+		}
+		return strings.Join(result.lines, "\n"), nil
+	}
+}
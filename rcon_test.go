@@ -0,0 +1,82 @@
+package sampquery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rconServer answers RCON requests carrying password with one packet per line of output
+func rconServer(t *testing.T, password string, output map[string][]string) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request := buf[:n]
+			if n < 13 || QueryType(request[10]) != RCON {
+				continue
+			}
+
+			ptr := 11
+			length := int(binary.LittleEndian.Uint16(request[ptr:]))
+			ptr += 2
+			if string(request[ptr:ptr+length]) != password {
+				continue
+			}
+			ptr += length
+			length = int(binary.LittleEndian.Uint16(request[ptr:]))
+			ptr += 2
+			command := string(request[ptr : ptr+length])
+
+			for _, line := range output[command] {
+				reply := append([]byte(nil), request[:11]...)
+				reply = binary.LittleEndian.AppendUint16(reply, uint16(len(line)))
+				conn.WriteToUDP(append(reply, line...), addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestQuery_SendRCON(t *testing.T) {
+	addr := rconServer(t, "changeme", map[string][]string{
+		"players": {"ID\tName\tPing\tIP", "0\tSouthclaws\t20\t127.0.0.1"},
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	output, err := query.SendRCON(ctx, "changeme", "players")
+	assert.NoError(t, err)
+	assert.Equal(t, "ID\tName\tPing\tIP\n0\tSouthclaws\t20\t127.0.0.1", output)
+}
+
+func TestQuery_SendRCON_WrongPassword(t *testing.T) {
+	addr := rconServer(t, "changeme", map[string][]string{"players": {"output"}})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = query.SendRCON(ctx, "wrong", "players")
+	assert.EqualError(t, err, "socket read timed out")
+}
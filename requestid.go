@@ -0,0 +1,38 @@
+package sampquery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying id, which a Query created with it by
+// NewQueryContext, or any of the functions built on it such as GetServerInfo, adds to all of its log
+// lines. Use it to tie a query's logs to whatever asked for it.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id carried by ctx, if any.
+func RequestIDFromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(requestIDKey{}).(string)
+	return
+}
+
+// RequestID returns the id added to every line this query logs as "request_id", so the lines for one
+// query can be picked out of a concurrent scan. It's taken from the context the query was created
+// with or generated, and shared by clones.
+func (query *Query) RequestID() string {
+	return query.requestID
+}
+
+// newRequestID generates a random 8 character request id.
+func newRequestID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,60 @@
+package sampquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	addr := mockSAMPServer(t, nil)
+
+	// requestIDs returns the request id of every line logged to buf
+	requestIDs := func(buf *bytes.Buffer) (ids []string) {
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+			id, _ := entry["request_id"].(string)
+			ids = append(ids, id)
+		}
+		return
+	}
+	logger := func(buf *bytes.Buffer) *slog.Logger {
+		return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	buf := new(bytes.Buffer)
+	_, err := GetServerInfo(ContextWithRequestID(ctx, "scan-42"), addr, false, WithLogger(logger(buf)), WithParallel(true))
+	assert.NoError(t, err)
+	ids := requestIDs(buf)
+	assert.True(t, len(ids) > 3, "only %d lines logged", len(ids))
+	for _, id := range ids {
+		assert.Equal(t, "scan-42", id)
+	}
+
+	// without one in the context each query generates its own
+	buf = new(bytes.Buffer)
+	query, err := NewQuery(addr, WithLogger(logger(buf)))
+	assert.NoError(t, err)
+	assert.Len(t, query.RequestID(), 8)
+
+	_, err = query.GetInfo(ctx, false)
+	assert.NoError(t, err)
+	for _, id := range requestIDs(buf) {
+		assert.Equal(t, query.RequestID(), id)
+	}
+
+	other, err := NewQuery(addr)
+	assert.NoError(t, err)
+	assert.NotEqual(t, query.RequestID(), other.RequestID())
+	assert.Equal(t, query.RequestID(), query.Clone().RequestID())
+}
@@ -0,0 +1,136 @@
+package sampquery
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CommonRules holds the well-known rules every SA:MP server sends, parsed into typed fields.
+type CommonRules struct {
+	LagComp   bool   `json:"lagcomp"`
+	MapName   string `json:"mapname"`
+	Version   string `json:"version"`
+	Weather   int    `json:"weather"`
+	WebURL    string `json:"weburl"`
+	WorldTime string `json:"worldtime"`
+
+	// DL holds the rules only 0.3.DL and open.mp servers send, it's nil for other servers.
+	DL *DLRules `json:"dl,omitempty"`
+
+	// Raw holds every other rule, along with any well-known rule whose value couldn't be parsed.
+	Raw map[string]string `json:"raw,omitempty"`
+}
+
+// DLRules holds the rules sent by servers running 0.3.DL, or open.mp which is compatible with it,
+// describing the custom content players download when joining.
+type DLRules struct {
+	// Artwork is whether the server serves custom models and textures.
+	Artwork bool `json:"artwork"`
+	// ArtworkURL is where the content is downloaded from, when hosted separately from the server.
+	ArtworkURL string `json:"artwork_url,omitempty"`
+}
+
+// ParseDLRules picks the 0.3.DL rules out of a server's rules, ok is false if the server doesn't
+// support downloads, which is decided by the presence of the allow_DL rule.
+func ParseDLRules(rules map[string]string) (dl DLRules, ok bool) {
+	if _, ok = rules["allow_DL"]; !ok {
+		return
+	}
+	dl.Artwork = parseRuleBool(rules["artwork"])
+	dl.ArtworkURL = rules["artwork_url"]
+	return dl, true
+}
+
+// DiffRules compares two sets of rules, such as from successive queries of a server, returning the
+// names of rules only in new, the names of rules only in old, each sorted, and the rules whose
+// values differ keyed by name with their old and new values.
+func DiffRules(old, new map[string]string) (added, removed []string, changed map[string][2]string) {
+	changed = make(map[string][2]string)
+	for name, value := range new {
+		oldValue, ok := old[name]
+		if !ok {
+			added = append(added, name)
+		} else if oldValue != value {
+			changed[name] = [2]string{oldValue, value}
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// defaultMapName is what the SA:MP client shows for servers that don't send a mapname rule.
+const defaultMapName = "San Andreas"
+
+// MapName returns the server's mapname rule, or "San Andreas" when it's missing or blank.
+func (s Server) MapName() string {
+	if name := strings.TrimSpace(s.Rules["mapname"]); name != "" {
+		return name
+	}
+	return defaultMapName
+}
+
+// parseRuleBool parses the ways servers write booleans in rules: "On", "Yes", "1" and "true".
+func parseRuleBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "on", "yes", "1", "true":
+		return true
+	}
+	return false
+}
+
+// GetCommonRules fetches the rules with GetRules and picks out the well-known keys. Like GetRules, it
+// returns whatever rules it could along with ErrRulesTruncated for a truncated response.
+func (query *Query) GetCommonRules(ctx context.Context) (common CommonRules, err error) {
+	rules, err := query.GetRules(ctx)
+	if err != nil && err != ErrRulesTruncated {
+		return
+	}
+
+	return parseCommonRules(rules), err
+}
+
+func parseCommonRules(rules map[string]string) (common CommonRules) {
+	common.Raw = make(map[string]string)
+
+	if dl, ok := ParseDLRules(rules); ok {
+		common.DL = &dl
+	}
+
+	for key, value := range rules {
+		switch key {
+		case "allow_DL", "artwork", "artwork_url":
+			if common.DL == nil {
+				common.Raw[key] = value
+			}
+		case "lagcomp":
+			common.LagComp = parseRuleBool(value)
+		case "mapname":
+			common.MapName = value
+		case "version":
+			common.Version = value
+		case "weather":
+			weather, err := strconv.Atoi(value)
+			if err != nil {
+				common.Raw[key] = value
+				continue
+			}
+			common.Weather = weather
+		case "weburl":
+			common.WebURL = value
+		case "worldtime":
+			common.WorldTime = value
+		default:
+			common.Raw[key] = value
+		}
+	}
+
+	return
+}
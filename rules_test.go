@@ -0,0 +1,111 @@
+package sampquery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery_GetCommonRules(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildRulesPayload([][2]string{
+			{"lagcomp", "On"},
+			{"mapname", "San Andreas"},
+			{"version", "0.3.7-R2"},
+			{"weather", "10"},
+			{"weburl", "www.sa-mp.com"},
+			{"worldtime", "12:00"},
+			{"discord", "discord.gg/samp"},
+		}))
+	})
+
+	query, err := NewQuery(addr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	common, err := query.GetCommonRules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, CommonRules{
+		LagComp:   true,
+		MapName:   "San Andreas",
+		Version:   "0.3.7-R2",
+		Weather:   10,
+		WebURL:    "www.sa-mp.com",
+		WorldTime: "12:00",
+		Raw:       map[string]string{"discord": "discord.gg/samp"},
+	}, common)
+}
+
+func TestParseCommonRules_BadWeather(t *testing.T) {
+	common := parseCommonRules(map[string]string{"weather": "sunny"})
+	assert.Equal(t, 0, common.Weather)
+	assert.Equal(t, map[string]string{"weather": "sunny"}, common.Raw)
+}
+
+func TestParseDLRules(t *testing.T) {
+	rules := map[string]string{
+		"allow_DL":    "1",
+		"artwork":     "Yes",
+		"artwork_url": "https://cdn.example.com/models",
+		"version":     "0.3.DL-R1",
+	}
+
+	dl, ok := ParseDLRules(rules)
+	assert.True(t, ok)
+	assert.Equal(t, DLRules{Artwork: true, ArtworkURL: "https://cdn.example.com/models"}, dl)
+
+	common := parseCommonRules(rules)
+	assert.Equal(t, &dl, common.DL)
+	assert.Equal(t, "0.3.DL-R1", common.Version)
+	assert.Empty(t, common.Raw)
+
+	delete(rules, "allow_DL")
+	_, ok = ParseDLRules(rules)
+	assert.False(t, ok)
+
+	common = parseCommonRules(rules)
+	assert.Nil(t, common.DL)
+	assert.Equal(t, map[string]string{"artwork": "Yes", "artwork_url": "https://cdn.example.com/models"}, common.Raw)
+}
+
+func TestServer_MapName(t *testing.T) {
+	assert.Equal(t, "Los Santos", Server{Rules: map[string]string{"mapname": "Los Santos"}}.MapName())
+	assert.Equal(t, "San Andreas", Server{Rules: map[string]string{"mapname": " "}}.MapName())
+	assert.Equal(t, "San Andreas", Server{Rules: map[string]string{"version": "0.3.7"}}.MapName())
+	assert.Equal(t, "San Andreas", Server{}.MapName())
+}
+
+func TestDiffRules(t *testing.T) {
+	old := map[string]string{
+		"version":   "0.3.7-R2",
+		"mapname":   "San Andreas",
+		"weather":   "10",
+		"worldtime": "12:00",
+	}
+	new := map[string]string{
+		"version":  "omp 1.2.0",
+		"mapname":  "San Andreas",
+		"weather":  "10",
+		"weburl":   "open.mp",
+		"allow_DL": "1",
+	}
+
+	added, removed, changed := DiffRules(old, new)
+	assert.Equal(t, []string{"allow_DL", "weburl"}, added)
+	assert.Equal(t, []string{"worldtime"}, removed)
+	assert.Equal(t, map[string][2]string{"version": {"0.3.7-R2", "omp 1.2.0"}}, changed)
+
+	added, removed, changed = DiffRules(new, new)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+
+	added, removed, changed = DiffRules(nil, map[string]string{"version": "0.3.7"})
+	assert.Equal(t, []string{"version"}, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+}
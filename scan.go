@@ -0,0 +1,113 @@
+package sampquery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ScanRange looks for servers listening on port at every host address in the IPv4 range cidr, with
+// up to concurrency queries in flight at once. Only the info query is sent, which is enough to tell
+// a server is there, with decoding attempted so hostnames are readable. Callers can follow up with
+// GetServerInfo for the rest. Each host is given timeout to answer, or a second if it's zero or less.
+// Hosts that don't answer are left out, so the result is the servers found before ctx was done,
+// sorted by address.
+func ScanRange(ctx context.Context, cidr string, port int, concurrency int, timeout time.Duration, opts ...Option) (servers []Server, err error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid range")
+	}
+	if ip.To4() == nil {
+		return nil, errors.Errorf("range %s is IPv6, only IPv4 is supported", cidr)
+	}
+	if port < 1 || port > 65535 {
+		return nil, errors.Errorf("invalid port %d", port)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	first := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	last := first | (1<<uint(bits-ones) - 1)
+	// leave out the network and broadcast addresses, except in /31 and /32 ranges which have none
+	if bits-ones > 1 {
+		first++
+		last--
+	}
+
+	type found struct {
+		n      uint32
+		server Server
+	}
+	var results []found
+
+	hosts := make(chan uint32)
+	go func() {
+		defer close(hosts)
+		for n := uint64(first); n <= uint64(last); n++ {
+			select {
+			case hosts <- uint32(n):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range hosts {
+				addr := make(net.IP, 4)
+				binary.BigEndian.PutUint32(addr, n)
+				server, err := scanHost(ctx, net.JoinHostPort(addr.String(), strconv.Itoa(port)), timeout, opts)
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				results = append(results, found{n, server})
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].n < results[j].n })
+	for _, result := range results {
+		servers = append(servers, result.server)
+	}
+	return servers, nil
+}
+
+func scanHost(ctx context.Context, host string, timeout time.Duration, opts []Option) (server Server, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query, err := NewQueryContext(ctx, host, opts...)
+	if err != nil {
+		return
+	}
+	defer query.Close()
+
+	server, err = query.GetInfo(ctx, true)
+	server.Address = host
+	server.ResolvedAddress = host
+	if err == nil {
+		server.QueriedAt = query.now()
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package sampquery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanRange(t *testing.T) {
+	addr := mockServer(t, func(request []byte) []byte {
+		return buildResponse(request, buildInfoPayload(false, 1, 50, "hostname", "gamemode", "English"))
+	})
+	_, portStr, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// 127.0.0.1 and 127.0.0.2, of which only the first has anything listening
+	servers, err := ScanRange(ctx, "127.0.0.0/30", port, 2, 200*time.Millisecond)
+	assert.NoError(t, err)
+	if assert.Len(t, servers, 1) {
+		assert.Equal(t, addr, servers[0].Address)
+		assert.Equal(t, "hostname", servers[0].Hostname)
+	}
+}
+
+func TestScanRange_Invalid(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := ScanRange(ctx, "127.0.0.1", 7777, 1, 0)
+	assert.EqualError(t, err, "invalid range: invalid CIDR address: 127.0.0.1")
+
+	_, err = ScanRange(ctx, "::1/128", 7777, 1, 0)
+	assert.EqualError(t, err, "range ::1/128 is IPv6, only IPv4 is supported")
+}